@@ -5,7 +5,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/goshuirc/bnc/lib"
@@ -13,6 +18,8 @@ import (
 
 	// Different parts of the project acting independantly
 	"github.com/goshuirc/bnc/lib/components/componentLoader"
+	"github.com/goshuirc/bnc/lib/components/messageLogger"
+	"github.com/goshuirc/bnc/lib/logtools"
 
 	"github.com/goshuirc/bnc/lib/datastores/buntdb"
 )
@@ -25,13 +32,21 @@ GoshuBNC is an IRC bouncer.
 Usage:
 	bnc init [--conf <filename>]
 	bnc start [--conf <filename>]
+	bnc logs export <user> <network> <buffer> [--from <time>] [--to <time>] [--format <format>] [--limit <num>] [--output <filename>] [--conf <filename>]
+	bnc logs import <format> <user> <network> <buffer> <file>... [--timezone <zone>] [--conf <filename>]
 	bnc -h | --help
 	bnc --version
 
 Options:
-	--conf <filename>  Configuration file to use [default: bnc.yaml].
-	-h --help          Show this screen.
-	--version          Show version.`
+	--conf <filename>    Configuration file to use [default: bnc.yaml].
+	--from <time>        Export messages from this time, as RFC3339 or YYYY-MM-DD [HH:MM[:SS]].
+	--to <time>          Export messages up to this time [default: now].
+	--format <format>    Export format: jsonl, text or html [default: text].
+	--limit <num>        Most messages to export [default: 100000].
+	--output <filename>  File to export to [default: -].
+	--timezone <zone>    Timezone the imported logs were written in, such as Europe/London [default: Local].
+	-h --help            Show this screen.
+	--version            Show version.`
 
 	arguments, _ := docopt.Parse(usage, nil, true, ircbnc.SemVer, false)
 
@@ -63,6 +78,12 @@ Options:
 
 		ircsetup.InitialSetup(manager)
 
+	} else if arguments["logs"].(bool) && arguments["export"].(bool) {
+		exportLogs(manager, arguments)
+
+	} else if arguments["logs"].(bool) && arguments["import"].(bool) {
+		importLogs(manager, arguments)
+
 	} else if arguments["start"].(bool) {
 		fmt.Println("Starting", ircsetup.CbCyan("GoshuBNC"))
 
@@ -89,3 +110,147 @@ func getDataStoreInstance(config *ircbnc.Config) (ircbnc.DataStoreInterface, str
 	}
 	return data, storageType
 }
+
+func exportLogs(manager *ircbnc.Manager, arguments map[string]interface{}) {
+	for _, user := range manager.Ds.GetAllUsers() {
+		manager.Users[user.ID] = user
+	}
+
+	userID := strings.ToLower(arguments["<user>"].(string))
+	user, exists := manager.Users[userID]
+	if !exists {
+		log.Fatal("User " + userID + " does not exist")
+	}
+
+	// Encrypted messages can't be read without the user's log key
+	if user.LogEncryptionEnabled() {
+		password, err := ircsetup.QueryNoEcho("Password for " + user.ID + ": ")
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = user.UnlockLogKey(password)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer user.ReleaseLogKey()
+	}
+
+	store := bncComponentLogger.NewMessageDatastore(manager)
+	if store == nil {
+		log.Fatal("No message store has been configured")
+	}
+
+	options := bncLogTools.ExportOptions{
+		UserID:    user.ID,
+		NetworkID: arguments["<network>"].(string),
+		Buffer:    arguments["<buffer>"].(string),
+		Format:    arguments["--format"].(string),
+		Location:  user.Location(),
+	}
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+
+	var err error
+	if from, isSet := arguments["--from"].(string); isSet {
+		options.From, err = bncLogTools.ParseExportTime(from, options.Location)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if to := arguments["--to"].(string); to != "now" {
+		options.To, err = bncLogTools.ParseExportTime(to, options.Location)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	options.Limit, err = strconv.Atoi(arguments["--limit"].(string))
+	if err != nil {
+		log.Fatal("Invalid limit: ", err.Error())
+	}
+
+	output := os.Stdout
+	if filename := arguments["--output"].(string); filename != "-" {
+		output, err = os.Create(filename)
+		if err != nil {
+			log.Fatal("Could not create the export file: ", err.Error())
+		}
+		defer output.Close()
+	}
+
+	count, err := bncLogTools.Export(store, output, options)
+	if err != nil {
+		log.Fatal("Could not export messages: ", err.Error())
+	}
+	log.Printf("Exported %d messages", count)
+}
+
+func importLogs(manager *ircbnc.Manager, arguments map[string]interface{}) {
+	for _, user := range manager.Ds.GetAllUsers() {
+		manager.Users[user.ID] = user
+	}
+
+	format := strings.ToLower(arguments["<format>"].(string))
+	parse, exists := bncLogTools.ImportFormats[format]
+	if !exists {
+		log.Fatal("Unknown log format " + format + ", use znc, irssi or weechat")
+	}
+
+	userID := strings.ToLower(arguments["<user>"].(string))
+	user, exists := manager.Users[userID]
+	if !exists {
+		log.Fatal("User " + userID + " does not exist")
+	}
+
+	networkID := arguments["<network>"].(string)
+	if _, exists := user.Networks[networkID]; !exists {
+		log.Fatal("Network " + networkID + " does not exist for user " + userID)
+	}
+
+	location, err := time.LoadLocation(arguments["--timezone"].(string))
+	if err != nil {
+		log.Fatal("Invalid timezone: ", err.Error())
+	}
+
+	// Encrypted messages have to be read back to tell which have already been imported
+	if user.LogEncryptionEnabled() {
+		password, err := ircsetup.QueryNoEcho("Password for " + user.ID + ": ")
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = user.UnlockLogKey(password)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer user.ReleaseLogKey()
+	}
+
+	store := bncComponentLogger.NewMessageDatastore(manager)
+	if store == nil {
+		log.Fatal("No message store has been configured")
+	}
+	if closer, canClose := store.(io.Closer); canClose {
+		defer closer.Close()
+	}
+
+	buffer := arguments["<buffer>"].(string)
+	messages := []bncLogTools.ImportedMessage{}
+	for _, filename := range arguments["<file>"].([]string) {
+		file, err := os.Open(filename)
+		if err != nil {
+			log.Fatal("Could not open the log file: ", err.Error())
+		}
+		parsed, err := parse(file, filename, buffer, location)
+		file.Close()
+		if err != nil {
+			log.Fatal("Could not read "+filename+": ", err.Error())
+		}
+		messages = append(messages, parsed...)
+	}
+
+	imported, skipped, err := bncLogTools.Import(store, user, networkID, buffer, messages)
+	if err != nil {
+		log.Fatal("Could not import messages: ", err.Error())
+	}
+	log.Printf("Imported %d messages, skipped %d that were already stored", imported, skipped)
+}
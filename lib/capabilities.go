@@ -33,6 +33,8 @@ func init() {
 	CapInviteNotify(&Capabilities)
 	CapUserhostInNames(&Capabilities)
 	CapBatch(&Capabilities)
+	CapReadMarker(&Capabilities)
+	CapMultiNetwork(&Capabilities)
 }
 
 // SupportedString returns a list ready to send to the client of all our CAPs
@@ -129,7 +131,9 @@ func CapServerTime(caps *CapManager) {
 	caps.FnsMessageToClient = append(
 		caps.FnsMessageToClient,
 		func(listener *Listener, message *ircmsg.IrcMessage) bool {
+			// Clients may have tags enabled by other caps without wanting the time
 			if !listener.IsCapEnabled(name) {
+				delete(message.Tags, "time")
 				return false
 			}
 
@@ -265,7 +269,29 @@ func CapUserhostInNames(caps *CapManager) {
  * Not used on it's own, but other commands such as CHATHISTORY make use of it
  */
 func CapBatch(caps *CapManager) {
-	caps.Supported["batch"] = ""
+	name := "batch"
+	caps.Supported[name] = ""
+
+	// Batched messages are marked with the batch tag
+	caps.FnsInitListener[name] = func(listener *Listener) {
+		listener.TagsEnabled = true
+	}
+}
+
+/**
+ * CAP: draft/read-marker
+ * MARKREAD is handled as a client command, clients without the cap just never get told about markers
+ */
+func CapReadMarker(caps *CapManager) {
+	caps.Supported[ReadMarkerCap] = ""
+}
+
+/**
+ * CAP: goshuirc.net/multi-network
+ * The listener is moved onto all of the user's networks once it registers
+ */
+func CapMultiNetwork(caps *CapManager) {
+	caps.Supported[MultiNetworkCap] = ""
 }
 
 func SplitMask(mask string) (string, string, string) {
@@ -0,0 +1,222 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"log"
+	"strings"
+
+	"github.com/goshuirc/bnc/lib/ircclient"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+/**
+ * Channel keys are learned from what goes past: the keys clients join with, +k and -k
+ * mode changes and the channel modes the server replies with. They're kept on the
+ * channel's buffer so that it can be rejoined when we reconnect. Channels that can't be
+ * joined have the reason kept on their buffer too.
+ */
+
+// joinErrors are the numerics the server refuses to let us join a channel with
+var joinErrors = []string{
+	ircclient.ERR_CHANNELISFULL,
+	ircclient.ERR_INVITEONLYCHAN,
+	ircclient.ERR_BANNEDFROMCHAN,
+	ircclient.ERR_BADCHANNELKEY,
+	ircclient.ERR_NOCHANMODES,
+}
+
+// SetKey sets the key the channel is joined with, or stops using one if the key is blank.
+// Returns false if nothing changed.
+func (buffer *ServerConnectionBuffer) SetKey(key string) bool {
+	useKey := key != ""
+	if buffer.Key == key && buffer.UseKey == useKey {
+		return false
+	}
+
+	buffer.Key = key
+	buffer.UseKey = useKey
+	return true
+}
+
+// JoinKey returns the key the channel should be joined with.
+func (buffer *ServerConnectionBuffer) JoinKey() string {
+	if !buffer.UseKey {
+		return ""
+	}
+	return buffer.Key
+}
+
+// RememberJoinKeys keeps the keys a client is joining channels with, until we see if the joins work
+func (sc *ServerConnection) RememberJoinKeys(channels string, keys string) {
+	channelNames := strings.Split(channels, ",")
+	channelKeys := strings.Split(keys, ",")
+
+	sc.joinKeysLock.Lock()
+	defer sc.joinKeysLock.Unlock()
+
+	if sc.joinKeys == nil {
+		sc.joinKeys = make(map[string]string)
+	}
+	for i, name := range channelNames {
+		if i < len(channelKeys) && channelKeys[i] != "" {
+			sc.joinKeys[strings.ToLower(name)] = channelKeys[i]
+		}
+	}
+}
+
+// takeJoinKey returns the key a client joined the channel with and forgets it
+func (sc *ServerConnection) takeJoinKey(name string) (string, bool) {
+	sc.joinKeysLock.Lock()
+	defer sc.joinKeysLock.Unlock()
+
+	name = strings.ToLower(name)
+	key, exists := sc.joinKeys[name]
+	delete(sc.joinKeys, name)
+	return key, exists
+}
+
+// modeTakesParam returns true if setting or unsetting the given channel mode takes a param
+func (sc *ServerConnection) modeTakesParam(mode rune, adding bool) bool {
+	sc.Foo.RLock()
+	chanModes, hasChanModes := sc.Foo.Supported["CHANMODES"]
+	prefix, hasPrefix := sc.Foo.Supported["PREFIX"]
+	sc.Foo.RUnlock()
+
+	if !hasChanModes {
+		chanModes = "beI,k,l,imnpst"
+	}
+	if !hasPrefix {
+		prefix = "(ov)@+"
+	}
+
+	if end := strings.Index(prefix, ")"); strings.HasPrefix(prefix, "(") && end > 0 {
+		if strings.ContainsRune(prefix[1:end], mode) {
+			return true
+		}
+	}
+
+	// Types A and B always take a param, type C only when it's being set
+	types := strings.Split(chanModes, ",")
+	for i, modes := range types {
+		if !strings.ContainsRune(modes, mode) {
+			continue
+		}
+		return i < 2 || i == 2 && adding
+	}
+	return false
+}
+
+// channelKeyChange looks for a key being set or removed in the given mode changes, returning
+// the new key, whether it was changed and whether +k was seen at all
+func (sc *ServerConnection) channelKeyChange(modes string, params []string) (string, bool, bool) {
+	key := ""
+	changed, seen := false, false
+	adding := true
+	idx := 0
+
+	for _, mode := range modes {
+		switch {
+		case mode == '+' || mode == '-':
+			adding = mode == '+'
+		case mode == 'k':
+			param := ""
+			if idx < len(params) && sc.modeTakesParam(mode, adding) {
+				param = params[idx]
+				idx++
+			}
+			if !adding {
+				key, changed = "", true
+			} else if param != "" && param != "*" {
+				// Servers hide keys from those who can't see them as *
+				key, changed, seen = param, true, true
+			} else {
+				seen = true
+			}
+		default:
+			if sc.modeTakesParam(mode, adding) {
+				idx++
+			}
+		}
+	}
+
+	return key, changed, seen
+}
+
+func (sc *ServerConnection) handleModeKey(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 {
+		return
+	}
+
+	buffer := sc.Buffers.Get(message.Params[0])
+	if buffer == nil || !buffer.Channel {
+		return
+	}
+
+	key, changed, _ := sc.channelKeyChange(message.Params[1], message.Params[2:])
+	if changed && buffer.SetKey(key) {
+		sc.saveChannelKey(buffer)
+	}
+}
+
+// handleChannelModeIs learns the key from the full list of a channel's modes
+func (sc *ServerConnection) handleChannelModeIs(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 3 {
+		return
+	}
+
+	buffer := sc.Buffers.Get(message.Params[1])
+	if buffer == nil || !buffer.Channel {
+		return
+	}
+
+	key, changed, seen := sc.channelKeyChange(message.Params[2], message.Params[3:])
+	if !changed && seen {
+		return
+	}
+	// A channel without +k in its modes has no key
+	if buffer.SetKey(key) {
+		sc.saveChannelKey(buffer)
+	}
+}
+
+func (sc *ServerConnection) saveChannelKey(buffer *ServerConnectionBuffer) {
+	err := sc.Save()
+	if err != nil {
+		log.Println("Error saving the key of " + buffer.Name + ": " + err.Error())
+	}
+}
+
+// handleJoinError records why a channel couldn't be joined on its buffer and tells the user
+func (sc *ServerConnection) handleJoinError(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 {
+		return
+	}
+
+	name := message.Params[1]
+	sc.takeJoinKey(name)
+
+	// Only channels we keep have their errors remembered, clients see the numerics for the rest
+	buffer := sc.Buffers.Get(name)
+	if buffer == nil || !buffer.Channel {
+		return
+	}
+
+	reason := message.Params[len(message.Params)-1]
+	buffer.JoinError = reason
+	err := sc.Save()
+	if err != nil {
+		log.Println("Error saving the join error of " + buffer.Name + ": " + err.Error())
+	}
+
+	sc.ListenersLock.Lock()
+	for _, listener := range sc.Listeners {
+		if listener.Registered {
+			listener.SendStatus("Could not join " + buffer.Name + " on " + sc.Name + ": " + reason)
+		}
+	}
+	sc.ListenersLock.Unlock()
+
+	sc.rejoinFailed(buffer)
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Users can name the clients they connect with by logging in with user@client,
+ * such as dan@phone/freenode:password. Each named client keeps its own place in
+ * every buffer, its own playback settings and a history of its connections, so
+ * a phone and a desktop can each resume exactly where they left off.
+ */
+
+const (
+	// MaxClientIDLength is the longest a client ID can be
+	MaxClientIDLength = 32
+	// MaxClientHistory is how many of each client's connections are remembered
+	MaxClientHistory = 10
+)
+
+// UserClient holds what we remember about one of a user's clients
+type UserClient struct {
+	ID string
+	// PlaybackLimit and PlaybackTimestamp override the user's playback settings when set
+	PlaybackLimit     int
+	PlaybackTimestamp string
+	// History lists the client's latest connections, oldest first
+	History []*ClientConnection
+}
+
+// ClientConnection is a single connection made by a client
+type ClientConnection struct {
+	Network      string
+	Address      string
+	Connected    time.Time
+	Disconnected time.Time
+}
+
+// IsValidClientID returns true if the given client ID can be used.
+func IsValidClientID(clientID string) bool {
+	if clientID == "" || len(clientID) > MaxClientIDLength {
+		return false
+	}
+
+	for _, char := range clientID {
+		isLetter := char >= 'a' && char <= 'z'
+		isDigit := char >= '0' && char <= '9'
+		if !isLetter && !isDigit && !strings.ContainsRune("-_.", char) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// copy returns a copy of the client that can be read without holding the user's client lock
+func (client *UserClient) copy() *UserClient {
+	copied := *client
+	copied.History = make([]*ClientConnection, len(client.History))
+	for i, connection := range client.History {
+		connectionCopy := *connection
+		copied.History[i] = &connectionCopy
+	}
+	return &copied
+}
+
+// GetClient returns a copy of the given client, or nil if it has never connected.
+func (user *User) GetClient(clientID string) *UserClient {
+	user.clientsLock.Lock()
+	defer user.clientsLock.Unlock()
+
+	client, exists := user.Clients[clientID]
+	if !exists {
+		return nil
+	}
+	return client.copy()
+}
+
+// GetClients returns copies of all the user's clients, ordered by ID.
+func (user *User) GetClients() []*UserClient {
+	user.clientsLock.Lock()
+	defer user.clientsLock.Unlock()
+
+	clients := []*UserClient{}
+	for _, client := range user.Clients {
+		clients = append(clients, client.copy())
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+
+	return clients
+}
+
+// UpdateClient changes the settings of one of the user's clients. Returns false if the client doesn't exist.
+func (user *User) UpdateClient(clientID string, update func(client *UserClient)) bool {
+	user.clientsLock.Lock()
+	defer user.clientsLock.Unlock()
+
+	client, exists := user.Clients[clientID]
+	if !exists {
+		return false
+	}
+	update(client)
+	return true
+}
+
+// ForgetClient removes a client along with its place in every buffer.
+func (user *User) ForgetClient(clientID string) bool {
+	user.clientsLock.Lock()
+	_, exists := user.Clients[clientID]
+	delete(user.Clients, clientID)
+	user.clientsLock.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	for _, network := range user.Networks {
+		for _, buffer := range network.Buffers {
+			buffer.ForgetSeen(clientID)
+		}
+	}
+	return true
+}
+
+// clientConnected records a new connection made by one of the user's clients
+func (user *User) clientConnected(clientID string, network string, address string) *ClientConnection {
+	user.clientsLock.Lock()
+	defer user.clientsLock.Unlock()
+
+	if user.Clients == nil {
+		user.Clients = make(map[string]*UserClient)
+	}
+	client, exists := user.Clients[clientID]
+	if !exists {
+		client = &UserClient{
+			ID: clientID,
+		}
+		user.Clients[clientID] = client
+	}
+
+	connection := &ClientConnection{
+		Network:   network,
+		Address:   address,
+		Connected: time.Now().UTC(),
+	}
+	client.History = append(client.History, connection)
+	if len(client.History) > MaxClientHistory {
+		client.History = client.History[len(client.History)-MaxClientHistory:]
+	}
+
+	return connection
+}
+
+// clientDisconnected records the end of a client's connection
+func (user *User) clientDisconnected(connection *ClientConnection) {
+	user.clientsLock.Lock()
+	defer user.clientsLock.Unlock()
+
+	connection.Disconnected = time.Now().UTC()
+}
+
+// GetPlaybackLimit returns the most messages per buffer played back to this listener.
+func (listener *Listener) GetPlaybackLimit() int {
+	client := listener.User.GetClient(listener.ClientID)
+	if client != nil && client.PlaybackLimit > 0 {
+		return client.PlaybackLimit
+	}
+	return listener.User.GetPlaybackLimit()
+}
+
+// GetPlaybackTimestamp returns the timestamp messages played back to this listener are
+// prefixed with, or a blank string if they shouldn't be.
+func (listener *Listener) GetPlaybackTimestamp(ts time.Time) string {
+	client := listener.User.GetClient(listener.ClientID)
+	if client != nil && client.PlaybackTimestamp != "" {
+		return listener.User.FormatPlaybackTimestamp(client.PlaybackTimestamp, ts)
+	}
+	return listener.User.GetPlaybackTimestamp(ts)
+}
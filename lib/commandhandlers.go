@@ -9,6 +9,7 @@ import (
 
 	"log"
 
+	"github.com/goshuirc/bnc/lib/ircclient"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
@@ -20,7 +21,7 @@ func loadClientCommands() {
 			// always reject dodgy nicknames, makes things immensely easier
 			nick, nickError := IrcName(msg.Params[0], false)
 			if nickError != nil {
-				listener.Send(nil, "", "422", listener.ClientNick, msg.Params[0], "Erroneus nickname")
+				listener.Send(nil, "", ircclient.ERR_ERRONEUSNICKNAME, listener.ClientNick, msg.Params[0], "Erroneus nickname")
 				return true
 			}
 
@@ -30,9 +31,40 @@ func loadClientCommands() {
 				listener.regLocks.Set("nick", true)
 				return true
 			}
-			//TODO(dan): Handle NICK messages when connected to servers.
-			//listener.Send(nil, "", "ERROR", "We're supposed to handle NICK changes here!")
-			listener.ServerConnection.Nickname = nick
+
+			// Multi-network listeners have their own nick, the same on every network
+			if listener.MultiNetwork {
+				if nick != listener.ClientNick {
+					listener.Send(nil, listener.ClientNick, "NICK", nick)
+					listener.ClientNick = nick
+				}
+				return true
+			}
+
+			server := listener.ServerConnection
+			if server == nil {
+				listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, "You are not on a network so your nick can't be changed, use `jump <network>` to move onto one")
+				return true
+			}
+
+			if !server.Foo.Connected {
+				if !listener.User.SaveNick {
+					listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, "You are not connected to "+server.Name+" so your nick can't be changed")
+					return true
+				}
+
+				server.Nickname = nick
+				err := server.Save()
+				if err != nil {
+					listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, "Could not save your nick on "+server.Name)
+					return true
+				}
+				listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, "You are not connected to "+server.Name+", you will be "+nick+" when it connects")
+				return true
+			}
+
+			// The change is only made once the server confirms it
+			server.RequestNick(nick)
 			return false
 		},
 	}
@@ -63,14 +95,14 @@ func loadClientCommands() {
 			splitString := strings.SplitN(msg.Params[0], ":", 2)
 
 			if len(splitString) < 2 {
-				listener.Send(nil, "", "ERROR", `Password must be of the format "<username>/<network>:<password>"`)
+				listener.Send(nil, "", "ERROR", `Password must be of the format "<username>[@<client>]/<network>:<password>"`)
 				listener.Socket.Close()
 				return true
 			}
 
 			password := splitString[1]
 
-			var userid, networkID string
+			var userid, networkID, clientID string
 			if strings.Contains(splitString[0], "/") {
 				splitString = strings.Split(splitString[0], "/")
 				userid, networkID = splitString[0], splitString[1]
@@ -78,6 +110,17 @@ func loadClientCommands() {
 				userid = splitString[0]
 			}
 
+			// Clients can name themselves to keep their own state, as in user@client/network
+			if strings.Contains(userid, "@") {
+				splitString = strings.SplitN(userid, "@", 2)
+				userid, clientID = splitString[0], strings.ToLower(splitString[1])
+				if !IsValidClientID(clientID) {
+					listener.Send(nil, "", "ERROR", "Client IDs can only contain letters, numbers, dashes, underscores and dots")
+					listener.Socket.Close()
+					return true
+				}
+			}
+
 			authedUserId, authSuccess := listener.Manager.Ds.AuthUser(userid, password)
 			if !authSuccess {
 				listener.Socket.SetFinalData(fmt.Sprintf(":%s 464 %s :Invalid password\n", listener.Manager.Source, listener.ClientNick))
@@ -87,6 +130,18 @@ func loadClientCommands() {
 
 			user := listener.Manager.Users[authedUserId]
 			listener.User = user
+			listener.ClientID = clientID
+			if clientID != "" {
+				listener.clientConnection = user.clientConnected(clientID, networkID, listener.Socket.RemoteAddr())
+			}
+
+			// Stored messages can be decrypted while the user has a session
+			if user.LogEncryptionEnabled() {
+				err := listener.UnlockLogKey(password)
+				if err != nil {
+					log.Printf("Could not unlock the log key of %s: %s", user.ID, err.Error())
+				}
+			}
 
 			// An empty network ID may be a user logging in just to control his account or networks
 			if networkID != "" {
@@ -175,13 +230,60 @@ func loadClientCommands() {
 		},
 	}
 
+	ClientCommands["MARKREAD"] = ClientCommand{
+		minParams: 1,
+		handler: func(listener *Listener, msg ircmsg.IrcMessage) bool {
+			// Read markers are ours to keep, they never go upstream
+			server := listener.Server()
+			if server == nil {
+				listener.Send(nil, "", "FAIL", "MARKREAD", "INTERNAL_ERROR", msg.Params[0], "You are not connected to a network")
+				return true
+			}
+
+			target := msg.Params[0]
+			if len(msg.Params) < 2 {
+				server.SendReadMarker(listener, target)
+				return true
+			}
+
+			read, isValid := parseReadMarker(msg.Params[1])
+			if !isValid {
+				listener.Send(nil, "", "FAIL", "MARKREAD", "INVALID_PARAMS", target, "Invalid timestamp")
+				return true
+			}
+
+			if !server.SetReadMarker(target, read) {
+				listener.Send(nil, "", "FAIL", "MARKREAD", "INVALID_PARAMS", target, "Unknown buffer")
+			}
+			return true
+		},
+	}
+
+	ClientCommands["JOIN"] = ClientCommand{
+		minParams: 1,
+		handler: func(listener *Listener, msg ircmsg.IrcMessage) bool {
+			// Keys are kept once the server lets us in, so that we can rejoin later
+			server := listener.Server()
+			if server != nil && len(msg.Params) > 1 {
+				server.RememberJoinKeys(msg.Params[0], msg.Params[1])
+			}
+			return false
+		},
+	}
+
 	ClientCommands["PART"] = ClientCommand{
 		usablePreReg: true,
 		minParams:    1,
 		handler: func(listener *Listener, msg ircmsg.IrcMessage) bool {
+			server := listener.Server()
+			if server == nil {
+				return false
+			}
+
 			channelName := msg.Params[0]
-			listener.ServerConnection.Buffers.Remove(channelName)
-			listener.ServerConnection.Save()
+			server.StopRejoin(channelName)
+			server.Buffers.Remove(channelName)
+			server.Save()
 			return false
 		},
 	}
@@ -69,6 +69,8 @@ func (bouncer *Bouncer) onMessage(hook interface{}) {
 		bouncer.commandDelBuffer(listener, params, msg)
 	case "delnetwork":
 		bouncer.commandDelNetwork(listener, params, msg)
+	case "bind":
+		bouncer.commandBind(listener, params, msg)
 	}
 }
 
@@ -110,6 +112,32 @@ func (bouncer *Bouncer) commandDisconnectNetwork(listener *ircbnc.Listener, para
 	listener.Send(nil, "", "BOUNCER", "state", netName, "disconnected")
 }
 
+// [c] BOUNCER bind freenode
+// [s] BOUNCER bind freenode ERR_NETNOTFOUND
+// [s] BOUNCER bind freenode ERR_UNKNOWN :You are already on freenode
+// [s] BOUNCER bind freenode RPL_OK
+func (bouncer *Bouncer) commandBind(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) == 0 {
+		listener.SendLine("BOUNCER bind * ERR_INVALIDARGS")
+		return
+	}
+
+	netName := params[0]
+	net := getNetworkByName(listener, netName)
+	if net == nil {
+		listener.SendLine(fmt.Sprintf("BOUNCER bind %s ERR_NETNOTFOUND", netName))
+		return
+	}
+
+	err := listener.SwitchNetwork(net)
+	if err != nil {
+		listener.Send(nil, "", "BOUNCER", "bind", netName, "ERR_UNKNOWN", err.Error())
+		return
+	}
+
+	listener.Send(nil, "", "BOUNCER", "bind", netName, "RPL_OK")
+}
+
 // [c] bouncer listnetworks
 // [s] bouncer listnetworks network=freenode;host=irc.freenode.net;port=6667;state=disconnected;
 // [s] bouncer listnetworks network=snoonet;host=irc.snoonet.org;port=6697;state=connected;tls=1
@@ -168,12 +196,25 @@ func (bouncer *Bouncer) commandListBuffers(listener *ircbnc.Listener, params []s
 		vals["network"] = net.Name
 		vals["buffer"] = buffer.Name
 		vals["seen"] = buffer.LastSeen.Format(time.RFC3339)
+		if buffer.LogMode != ircbnc.LogModeDefault {
+			vals["log"] = buffer.LogMode
+		}
 
 		if buffer.Channel {
 			vals["channel"] = "1"
 			// TODO: Store the topic in the channels when we have them
 			vals["topic"] = ""
 			vals["joined"] = "1"
+			if buffer.JoinError != "" {
+				vals["joined"] = "0"
+				vals["joinerror"] = strings.Replace(buffer.JoinError, " ", "\\s", -1)
+			}
+			if buffer.Detached {
+				vals["detached"] = "1"
+				if buffer.Reattach != ircbnc.ReattachNever {
+					vals["reattach"] = buffer.Reattach
+				}
+			}
 		}
 
 		line := ""
@@ -203,6 +244,7 @@ func (bouncer *Bouncer) commandDelBuffer(listener *ircbnc.Listener, params []str
 		return
 	}
 
+	net.StopRejoin(bufferName)
 	net.Buffers.Remove(bufferName)
 	listener.Manager.Ds.SaveConnection(net)
 
@@ -228,7 +270,9 @@ func (bouncer *Bouncer) commandDelNetwork(listener *ircbnc.Listener, params []st
 	net.Disconnect()
 	listener.Send(nil, "", "BOUNCER", "state", netName, "disconnected")
 
+	listener.Manager.UsersLock.Lock()
 	delete(listener.User.Networks, net.Name)
+	listener.Manager.UsersLock.Unlock()
 	listener.Manager.Ds.DelConnection(net)
 }
 
@@ -303,7 +347,9 @@ func (bouncer *Bouncer) commandAddNetwork(listener *ircbnc.Listener, params []st
 		VerifyTLS: false,
 	}
 	connection.Addresses = append(connection.Addresses, newAddress)
+	listener.Manager.UsersLock.Lock()
 	listener.User.Networks[connection.Name] = connection
+	listener.Manager.UsersLock.Unlock()
 
 	saveErr := listener.Manager.Ds.SaveConnection(connection)
 	if saveErr != nil {
@@ -374,7 +420,7 @@ func (bouncer *Bouncer) commandChangeNetwork(listener *ircbnc.Listener, params [
 	}
 }
 
-// [c] bouncer changebuffer freenode buffername seen=;
+// [c] bouncer changebuffer freenode buffername seen=;log=none;
 // [s] bouncer changebuffer freenode buffername RPL_OK
 func (bouncer *Bouncer) commandChangeBuffer(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
 	if len(params) < 3 {
@@ -402,14 +448,66 @@ func (bouncer *Bouncer) commandChangeBuffer(listener *ircbnc.Listener, params []
 		return
 	}
 
+	// Everything is checked before anything is changed, so a bad value changes nothing
+	invalidArgs := fmt.Sprintf("BOUNCER changebuffer %s %s ERR_INVALIDARGS", net.Name, buffer.Name)
+
+	// An empty log mode goes back to using the user's log mode
+	_, hasLogMode := vars["log"]
+	logMode := strings.ToLower(tagValue(vars, "log", ""))
+	if hasLogMode && !ircbnc.IsValidLogMode(logMode) {
+		listener.SendLine(invalidArgs)
+		return
+	}
+
+	_, hasReattach := vars["reattach"]
+	reattach := strings.ToLower(tagValue(vars, "reattach", ""))
+	if hasReattach && !ircbnc.IsValidReattach(reattach) {
+		listener.SendLine(invalidArgs)
+		return
+	}
+
+	_, hasRejoin := vars["rejoin"]
+	rejoin := strings.ToLower(tagValue(vars, "rejoin", ""))
+	switch rejoin {
+	case ircbnc.RejoinOn, ircbnc.RejoinOff:
+	case "default", "":
+		rejoin = ircbnc.RejoinDefault
+	default:
+		if hasRejoin {
+			listener.SendLine(invalidArgs)
+			return
+		}
+	}
+
 	seen := tagValue(vars, "seen", "")
 	if seen != "" {
 		seenTime, seenErr := time.Parse(time.RFC3339, seen)
 		if seenErr != nil {
 			log.Println("Error parsing time for seen in BOUNCER: " + seenErr.Error())
 		} else {
-			buffer.LastSeen = seenTime.UTC()
+			// Other clients get told about the new read marker
+			net.SetReadMarker(buffer.Name, seenTime)
+		}
+	}
+
+	if hasLogMode {
+		buffer.LogMode = logMode
+	}
+	if hasRejoin {
+		buffer.Rejoin = rejoin
+	}
+
+	// Detaching keeps the buffer's current reattach filter unless a new one is given
+	_, hasDetached := vars["detached"]
+	if hasDetached && tagValue(vars, "detached", "") == "1" {
+		if !hasReattach {
+			reattach = buffer.Reattach
 		}
+		net.DetachBuffer(buffer.Name, reattach)
+	} else if hasDetached {
+		net.AttachBuffer(buffer.Name)
+	} else if hasReattach {
+		buffer.Reattach = reattach
 	}
 
 	saveErr := listener.Manager.Ds.SaveConnection(net)
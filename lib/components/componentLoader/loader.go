@@ -9,11 +9,17 @@ import (
 	// Different parts of the project acting independantly
 	"github.com/goshuirc/bnc/lib/components/bouncer"
 	"github.com/goshuirc/bnc/lib/components/control"
+	"github.com/goshuirc/bnc/lib/components/ctcp"
+	"github.com/goshuirc/bnc/lib/components/highlights"
 	"github.com/goshuirc/bnc/lib/components/messageLogger"
+	"github.com/goshuirc/bnc/lib/components/notifications"
 )
 
 func Run(manager *ircbnc.Manager) {
 	bncComponentControl.Run(manager)
 	bncComponentLogger.Run(manager)
 	bncComponentBouncer.Run(manager)
+	bncComponentHighlights.Run(manager)
+	bncComponentNotifications.Run(manager)
+	bncComponentCtcp.Run(manager)
 }
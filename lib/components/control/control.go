@@ -6,11 +6,16 @@ package bncComponentControl
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/components/notifications"
+	"github.com/goshuirc/bnc/lib/logtools"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
@@ -36,21 +41,127 @@ var (
 			Usage:       "adduser <username> <password>",
 			Description: "Creates the given user with the given password",
 		},
+		"attach": {
+			Handler:     commandAttach,
+			Usage:       "attach <[network/]channel>",
+			Description: "Attaches a detached channel, sending it to your clients again",
+		},
+		"client": {
+			Handler:     commandClient,
+			Usage:       "client <client> [playback <limit>|timestamp <format|default|off>|forget]",
+			Description: "Shows or changes the settings of one of your clients, or forgets it",
+		},
 		"connect": {
 			Handler:     commandConnectNetwork,
 			Usage:       "connect [network]",
 			Description: "Connect to this (or the given) network",
 		},
+		"detach": {
+			Handler:     commandDetach,
+			Usage:       "detach [<[network/]channel> [highlight|message]]",
+			Description: "Lists your detached channels, or detaches a channel so it stays joined and logged without being sent to your clients. highlight or message reattaches it when it highlights you or anyone talks",
+		},
 		"disconnect": {
 			Handler:     commandDisconnectNetwork,
 			Usage:       "disconnect [network]",
 			Description: "Disconnect from this (or the given) network",
 		},
+		"encryptlogs": {
+			Handler:     commandEncryptLogs,
+			Usage:       "encryptlogs <password>",
+			Description: "Encrypts your stored messages so they can only be read while you're logged in",
+		},
+		"export": {
+			Handler:     commandExport,
+			Usage:       "export <[network/]buffer> [jsonl|text|html] [from] [to]",
+			Description: "Exports the stored messages of a buffer on this network to a file, times are YYYY-MM-DD or RFC3339",
+		},
+		"highlight": {
+			Handler:     commandHighlight,
+			Usage:       "highlight [nick on|off|add <keyword|regex> <pattern> [[network/]buffer]|exclude <[network/]buffer>|del <number>]",
+			Description: "Lists or changes the rules deciding what highlights you. Your mentions are kept in the *highlights query",
+		},
+		"ignore": {
+			Handler:     commandIgnore,
+			Usage:       "ignore [add <mask|account|regex> <pattern> [[network/]buffer|*] [event,...]|del <number>]",
+			Description: "Lists or changes your ignore rules, messages they match are never sent to your clients or logged. Events are " + strings.Join(ircbnc.IgnoreEvents, ", ") + ", rules without any only ignore " + strings.Join(ircbnc.DefaultIgnoreEvents, ", "),
+		},
+		"invite": {
+			Handler:     commandInvite,
+			Usage:       "invite [network] [add|del <nick|account:<account>>]",
+			Description: "Lists or changes who can invite you into channels on this network, their invites are joined automatically",
+		},
+		"jump": {
+			Handler:     commandJump,
+			Usage:       "jump <network>",
+			Description: "Moves this connection onto another of your networks",
+		},
+		"listclients": {
+			Handler:     commandListClients,
+			Usage:       "listclients",
+			Description: "Lists the clients you've connected with as <username>@<client>",
+		},
 		"listnetworks": {
 			Handler:     commandListNetworks,
 			Usage:       "listnetworks",
 			Description: "Lists all of your networks",
 		},
+		"logmode": {
+			Handler:     commandLogMode,
+			Usage:       "logmode [all|playback|none|default] [[network/]buffer]",
+			Description: "Shows or sets how your messages, or the messages of a buffer on this network, are logged. playback only keeps them in memory",
+		},
+		"mentions": {
+			Handler:     commandMentions,
+			Usage:       "mentions [count|clear]",
+			Description: "Shows your latest mentions, or clears them",
+		},
+		"messagestore": {
+			Handler:     commandMessageStore,
+			Usage:       "messagestore [default|memory] [size]",
+			Description: "Shows or sets where your messages are stored. memory keeps the last [size] messages of each buffer without writing anything to disk",
+		},
+		"notify": {
+			Handler:     commandNotify,
+			Usage:       "notify [add webhook <url> [template]|add exec <command>|del <number>|idle <minutes>|rate <per hour>|quiet <HH:MM-HH:MM|off>|test]",
+			Description: "Shows or changes where you're notified of highlights and private messages while you're away",
+		},
+		"password": {
+			Handler:     commandPassword,
+			Usage:       "password <current password> <new password>",
+			Description: "Changes your password",
+		},
+		"playback": {
+			Handler:     commandPlayback,
+			Usage:       "playback [limit]",
+			Description: "Shows or sets the most messages per buffer played back when you attach, 0 for the default",
+		},
+		"prune": {
+			Handler:     commandPrune,
+			OperOnly:    true,
+			Usage:       "prune",
+			Description: "Removes stored messages that fall outside the retention policies",
+		},
+		"rejoin": {
+			Handler:     commandRejoin,
+			Usage:       "rejoin [network] [on|off|delay <seconds>|tries <count>|channel <[network/]channel> <on|off|default>]",
+			Description: "Shows or sets whether channels on this network are rejoined after you're kicked from them, or overrides it for one channel",
+		},
+		"savenick": {
+			Handler:     commandSaveNick,
+			Usage:       "savenick [on|off]",
+			Description: "Shows or sets whether changing your nick on a network keeps it as that network's nick",
+		},
+		"timestamp": {
+			Handler:     commandTimestamp,
+			Usage:       "timestamp [format|default|off]",
+			Description: "Shows or sets how messages are timestamped when played back to clients without server-time, using %H, %M, %S, %d, %m and %Y",
+		},
+		"timezone": {
+			Handler:     commandTimezone,
+			Usage:       "timezone [zone]",
+			Description: "Shows or sets your timezone (e.g. Europe/London), used when writing your logs",
+		},
 	}
 )
 
@@ -170,15 +281,24 @@ func commandAddUser(listener *ircbnc.Listener, params []string, message ircmsg.I
 	}
 
 	// TODO: This should really be done in DataStore.SaveUser
+	manager.UsersLock.Lock()
 	manager.Users[user.ID] = user
+	manager.UsersLock.Unlock()
 
 	listener.SendStatus("User " + newUsername + " added")
 }
 
 func commandConnectNetwork(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
-	netName := listener.ServerConnection.Name
+	if len(params) < 1 && listener.ServerConnection == nil {
+		listener.SendStatus("Usage: connect <network>")
+		return
+	}
+
+	netName := ""
 	if len(params) >= 1 {
 		netName = params[0]
+	} else {
+		netName = listener.ServerConnection.Name
 	}
 
 	net, exists := listener.User.Networks[netName]
@@ -196,9 +316,16 @@ func commandConnectNetwork(listener *ircbnc.Listener, params []string, message i
 }
 
 func commandDisconnectNetwork(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
-	netName := listener.ServerConnection.Name
+	if len(params) < 1 && listener.ServerConnection == nil {
+		listener.SendStatus("Usage: disconnect <network>")
+		return
+	}
+
+	netName := ""
 	if len(params) >= 1 {
 		netName = params[0]
+	} else {
+		netName = listener.ServerConnection.Name
 	}
 
 	net, exists := listener.User.Networks[netName]
@@ -210,6 +337,27 @@ func commandDisconnectNetwork(listener *ircbnc.Listener, params []string, messag
 	net.Disconnect()
 }
 
+func commandJump(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: jump <network>")
+		return
+	}
+
+	net, exists := listener.User.Networks[params[0]]
+	if !exists {
+		listener.SendStatus("Network " + params[0] + " not found")
+		return
+	}
+
+	err := listener.SwitchNetwork(net)
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
+
+	listener.SendStatus("You are now on " + net.Name)
+}
+
 func commandListNetworks(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
 	table := NewTable()
 	table.SetHeader([]string{"Name", "Nick", "Connected", "Address"})
@@ -286,7 +434,9 @@ func commandAddNetwork(listener *ircbnc.Listener, params []string, message ircms
 		VerifyTLS: false,
 	}
 	connection.Addresses = append(connection.Addresses, newAddress)
+	listener.Manager.UsersLock.Lock()
 	listener.User.Networks[connection.Name] = connection
+	listener.Manager.UsersLock.Unlock()
 
 	err := listener.Manager.Ds.SaveConnection(connection)
 	if err != nil {
@@ -295,3 +445,1109 @@ func commandAddNetwork(listener *ircbnc.Listener, params []string, message ircms
 		listener.SendStatus("New network saved")
 	}
 }
+
+func commandPrune(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	listener.SendStatus("Pruning stored messages...")
+
+	stats, err := listener.Manager.PruneMessages()
+	if err != nil {
+		listener.SendStatus("Could not prune stored messages: " + err.Error())
+		return
+	}
+
+	listener.SendStatus("Pruning finished, " + stats.String())
+}
+
+func commandTimestamp(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		switch user.PlaybackTimestamp {
+		case ircbnc.PlaybackTimestampOff:
+			listener.SendStatus("Played back messages aren't timestamped")
+		case "":
+			listener.SendStatus("Played back messages are timestamped with the default format " + ircbnc.DefaultPlaybackTimestamp)
+		default:
+			listener.SendStatus("Played back messages are timestamped with " + user.PlaybackTimestamp)
+		}
+		return
+	}
+
+	format := strings.Join(params, " ")
+	switch strings.ToLower(format) {
+	case "default":
+		user.PlaybackTimestamp = ""
+	case ircbnc.PlaybackTimestampOff:
+		user.PlaybackTimestamp = ircbnc.PlaybackTimestampOff
+	default:
+		user.PlaybackTimestamp = format
+	}
+
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your timestamp format")
+	} else if user.PlaybackTimestamp == ircbnc.PlaybackTimestampOff {
+		listener.SendStatus("Played back messages will no longer be timestamped")
+	} else {
+		listener.SendStatus("Played back messages will now be timestamped like " + user.GetPlaybackTimestamp(time.Now()))
+	}
+}
+
+func commandTimezone(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		if user.Timezone == "" {
+			listener.SendStatus("You haven't set a timezone, the bouncer default is being used")
+		} else {
+			listener.SendStatus("Your timezone is " + user.Timezone)
+		}
+		return
+	}
+
+	_, err := time.LoadLocation(params[0])
+	if err != nil {
+		listener.SendStatus("Unknown timezone " + params[0])
+		return
+	}
+
+	user.Timezone = params[0]
+	err = listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your timezone")
+	} else {
+		listener.SendStatus("Timezone set to " + user.Timezone)
+	}
+}
+
+func commandSaveNick(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		if user.SaveNick {
+			listener.SendStatus("Nicks you change to are kept as the network's nick")
+		} else {
+			listener.SendStatus("Nicks you change to are only kept until you reconnect")
+		}
+		return
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "on":
+		user.SaveNick = true
+	case "off":
+		user.SaveNick = false
+	default:
+		listener.SendStatus("Usage: savenick [on|off]")
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your nick setting")
+	} else if user.SaveNick {
+		listener.SendStatus("Nicks you change to will now be kept as the network's nick")
+	} else {
+		listener.SendStatus("Nicks you change to will no longer be kept")
+	}
+}
+
+func commandMessageStore(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		if user.MessageStore == ircbnc.MessageStoreMemory {
+			size := "the default number of"
+			if user.MemoryBufferSize > 0 {
+				size = strconv.Itoa(user.MemoryBufferSize)
+			}
+			listener.SendStatus(fmt.Sprintf("Your messages are kept in memory, storing %s messages per buffer", size))
+		} else {
+			listener.SendStatus("Your messages are stored in the bouncer's message store")
+		}
+		return
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "default":
+		user.MessageStore = ircbnc.MessageStoreDefault
+	case ircbnc.MessageStoreMemory:
+		user.MessageStore = ircbnc.MessageStoreMemory
+		if len(params) > 1 {
+			size, err := strconv.Atoi(params[1])
+			if err != nil || size < 0 {
+				listener.SendStatus("Size must be a positive number, or 0 for the default")
+				return
+			}
+			user.MemoryBufferSize = size
+		}
+	default:
+		listener.SendStatus("Usage: messagestore [default|memory] [size]")
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your message store")
+	} else if user.MessageStore == ircbnc.MessageStoreMemory {
+		listener.SendStatus("Your messages will now only be kept in memory")
+	} else {
+		listener.SendStatus("Your messages will now be stored in the bouncer's message store")
+	}
+}
+
+func commandPlayback(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		listener.SendStatus(fmt.Sprintf("Up to %d messages per buffer are played back when you attach", user.GetPlaybackLimit()))
+		return
+	}
+
+	limit, err := strconv.Atoi(params[0])
+	if err != nil || limit < 0 {
+		listener.SendStatus("Usage: playback [limit]")
+		return
+	}
+
+	user.PlaybackLimit = limit
+	err = listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your playback limit")
+		return
+	}
+	listener.SendStatus(fmt.Sprintf("Up to %d messages per buffer will now be played back when you attach", user.GetPlaybackLimit()))
+}
+
+func commandHighlight(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+	usage := "Usage: highlight [nick on|off|add <keyword|regex> <pattern> [[network/]buffer]|exclude <[network/]buffer>|del <number>]"
+
+	if len(params) < 1 {
+		if user.HighlightNickOff {
+			listener.SendStatus("Your nick doesn't highlight you")
+		} else {
+			listener.SendStatus("Your nick highlights you")
+		}
+		for i, rule := range user.GetHighlightRules() {
+			listener.SendStatus(fmt.Sprintf("%d: %s", i+1, rule.String()))
+		}
+		return
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "nick":
+		if len(params) < 2 || (params[1] != "on" && params[1] != "off") {
+			listener.SendStatus("Usage: highlight nick on|off")
+			return
+		}
+		user.HighlightNickOff = params[1] == "off"
+
+	case "add":
+		if len(params) < 3 {
+			listener.SendStatus(usage)
+			return
+		}
+		network, buffer := "", ""
+		if len(params) > 3 {
+			network, buffer = splitBufferScope(params[3])
+		}
+		rule, err := ircbnc.NewHighlightRule(params[1], params[2], network, buffer)
+		if err == nil && rule.Kind == ircbnc.HighlightExclude {
+			listener.SendStatus(usage)
+			return
+		} else if err != nil {
+			listener.SendStatus("Invalid highlight rule: " + err.Error())
+			return
+		}
+		user.AddHighlightRule(rule)
+
+	case "exclude":
+		if len(params) < 2 {
+			listener.SendStatus(usage)
+			return
+		}
+		network, buffer := splitBufferScope(params[1])
+		rule, err := ircbnc.NewHighlightRule(ircbnc.HighlightExclude, "", network, buffer)
+		if err != nil {
+			listener.SendStatus("Invalid highlight rule: " + err.Error())
+			return
+		}
+		user.AddHighlightRule(rule)
+
+	case "del":
+		if len(params) < 2 {
+			listener.SendStatus(usage)
+			return
+		}
+		index, err := strconv.Atoi(params[1])
+		if err != nil || !user.DelHighlightRule(index-1) {
+			listener.SendStatus("No highlight rule " + params[1])
+			return
+		}
+
+	default:
+		listener.SendStatus(usage)
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your highlight rules")
+	} else {
+		listener.SendStatus("Your highlight rules have been updated")
+	}
+}
+
+func commandIgnore(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+	usage := "Usage: ignore [add <mask|account|regex> <pattern> [[network/]buffer|*] [event,...]|del <number>]"
+
+	if len(params) < 1 {
+		rules := user.GetIgnoreRules()
+		if len(rules) == 0 {
+			listener.SendStatus("You aren't ignoring anything")
+		}
+		for i, rule := range rules {
+			listener.SendStatus(fmt.Sprintf("%d: %s", i+1, rule.String()))
+		}
+		return
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "add":
+		if len(params) < 3 {
+			listener.SendStatus(usage)
+			return
+		}
+		// * applies the rule everywhere, so that events can be given without a buffer
+		network, buffer := "", ""
+		if len(params) > 3 && params[3] != "*" {
+			network, buffer = splitBufferScope(params[3])
+		}
+		var events []string
+		if len(params) > 4 {
+			events = strings.Split(params[4], ",")
+		}
+		rule, err := ircbnc.NewIgnoreRule(params[1], params[2], network, buffer, events)
+		if err != nil {
+			listener.SendStatus("Invalid ignore rule: " + err.Error())
+			return
+		}
+		user.AddIgnoreRule(rule)
+
+	case "del":
+		if len(params) < 2 {
+			listener.SendStatus(usage)
+			return
+		}
+		index, err := strconv.Atoi(params[1])
+		if err != nil || !user.DelIgnoreRule(index-1) {
+			listener.SendStatus("No ignore rule " + params[1])
+			return
+		}
+
+	default:
+		listener.SendStatus(usage)
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your ignore rules")
+	} else {
+		listener.SendStatus("Your ignore rules have been updated")
+	}
+}
+
+func commandMentions(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	count := 20
+	if len(params) > 0 {
+		if strings.ToLower(params[0]) == "clear" {
+			err := user.ClearMentions()
+			if err != nil {
+				listener.SendStatus("Could not clear your mentions")
+			} else {
+				listener.SendStatus("Your mentions have been cleared")
+			}
+			return
+		}
+
+		parsed, err := strconv.Atoi(params[0])
+		if err != nil || parsed < 1 {
+			listener.SendStatus("Usage: mentions [count|clear]")
+			return
+		}
+		count = parsed
+	}
+
+	mentions := user.GetMentions()
+	if len(mentions) == 0 {
+		listener.SendStatus("You haven't been mentioned")
+		return
+	}
+	if len(mentions) > count {
+		mentions = mentions[len(mentions)-count:]
+	}
+	for _, mention := range mentions {
+		nick, _, _ := ircbnc.SplitMask(mention.Prefix)
+		listener.SendStatus(fmt.Sprintf("[%s] %s/%s <%s> %s", formatStatusTime(user, mention.Time), mention.Network, mention.Buffer, nick, mention.Text))
+	}
+}
+
+func commandNotify(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+	usage := "Usage: notify [add webhook <url> [template]|add exec <command>|del <number>|idle <minutes>|rate <per hour>|quiet <HH:MM-HH:MM|off>|test]"
+
+	if len(params) < 1 {
+		settings := user.GetNotifySettings()
+		if len(settings.Targets) == 0 {
+			listener.SendStatus("You don't have any notification targets")
+			return
+		}
+		for i, target := range settings.Targets {
+			listener.SendStatus(fmt.Sprintf("%d: %s", i+1, target.String()))
+		}
+
+		when := "while no clients are attached"
+		if settings.IdleAfter > 0 {
+			when += fmt.Sprintf(" or you've been idle for %s", settings.IdleAfter.String())
+		}
+		rate := settings.Rate
+		if rate <= 0 {
+			rate = ircbnc.DefaultNotifyRate
+		}
+		listener.SendStatus(fmt.Sprintf("You're notified %s, up to %d times an hour", when, rate))
+		if settings.Quiet != nil {
+			listener.SendStatus("Your quiet hours are " + settings.Quiet.String())
+		}
+		return
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "add":
+		if len(params) < 3 {
+			listener.SendStatus(usage)
+			return
+		}
+		target, bodyTemplate := params[2], strings.Join(params[3:], " ")
+		if strings.ToLower(params[1]) == ircbnc.NotifyExec {
+			target, bodyTemplate = strings.Join(params[2:], " "), ""
+		}
+		notifyTarget, err := ircbnc.NewNotifyTarget(listener.Manager.Config, params[1], target, bodyTemplate)
+		if err != nil {
+			listener.SendStatus("Invalid notification target: " + err.Error())
+			return
+		}
+		user.UpdateNotifySettings(func(settings *ircbnc.NotifySettings) {
+			settings.Targets = append(settings.Targets, notifyTarget)
+		})
+
+	case "del":
+		index := -1
+		if len(params) > 1 {
+			index, _ = strconv.Atoi(params[1])
+			index--
+		}
+		removed := false
+		user.UpdateNotifySettings(func(settings *ircbnc.NotifySettings) {
+			if index >= 0 && index < len(settings.Targets) {
+				settings.Targets = append(settings.Targets[:index], settings.Targets[index+1:]...)
+				removed = true
+			}
+		})
+		if !removed {
+			listener.SendStatus("No notification target " + strings.Join(params[1:], " "))
+			return
+		}
+
+	case "idle":
+		minutes := -1
+		if len(params) > 1 {
+			minutes, _ = strconv.Atoi(params[1])
+		}
+		if minutes < 0 {
+			listener.SendStatus("Usage: notify idle <minutes>, or 0 to only be notified while no clients are attached")
+			return
+		}
+		user.UpdateNotifySettings(func(settings *ircbnc.NotifySettings) {
+			settings.IdleAfter = time.Duration(minutes) * time.Minute
+		})
+
+	case "rate":
+		rate := -1
+		if len(params) > 1 {
+			rate, _ = strconv.Atoi(params[1])
+		}
+		if rate < 0 {
+			listener.SendStatus("Usage: notify rate <per hour>, or 0 for the default")
+			return
+		}
+		user.UpdateNotifySettings(func(settings *ircbnc.NotifySettings) {
+			settings.Rate = rate
+		})
+
+	case "quiet":
+		if len(params) < 2 {
+			listener.SendStatus("Usage: notify quiet <HH:MM-HH:MM|off>")
+			return
+		}
+		var quiet *ircbnc.QuietHours
+		if strings.ToLower(params[1]) != "off" {
+			var err error
+			quiet, err = ircbnc.ParseQuietHours(params[1])
+			if err != nil {
+				listener.SendStatus(err.Error())
+				return
+			}
+		}
+		user.UpdateNotifySettings(func(settings *ircbnc.NotifySettings) {
+			settings.Quiet = quiet
+		})
+
+	case "test":
+		errs := bncComponentNotifications.SendTest(user)
+		for _, err := range errs {
+			listener.SendStatus("Notification failed: " + err.Error())
+		}
+		if len(errs) == 0 {
+			listener.SendStatus("Test notifications have been sent")
+		}
+		return
+
+	default:
+		listener.SendStatus(usage)
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your notification settings")
+	} else {
+		listener.SendStatus("Your notification settings have been updated")
+	}
+}
+
+// splitBufferScope splits network/buffer, where the network is optional
+func splitBufferScope(scope string) (string, string) {
+	if strings.Contains(scope, "/") {
+		parts := strings.SplitN(scope, "/", 2)
+		return parts[0], parts[1]
+	}
+	return "", scope
+}
+
+// bufferNetwork finds the network of a buffer given as [network/]buffer, defaulting to the listener's network
+func bufferNetwork(listener *ircbnc.Listener, scope string) (*ircbnc.ServerConnection, string) {
+	networkName, bufferName := splitBufferScope(scope)
+
+	// Multi-network clients name buffers as buffer/network, so that's tried when the
+	// network/ prefix doesn't name one of the user's networks
+	if _, isNetwork := listener.User.Networks[networkName]; listener.MultiNetwork && !isNetwork {
+		suffixBuffer, suffixNetwork := ircbnc.SplitNetworkName(scope)
+		if _, isSuffixNetwork := listener.User.Networks[suffixNetwork]; isSuffixNetwork {
+			networkName, bufferName = suffixNetwork, suffixBuffer
+		}
+	}
+	if networkName == "" {
+		return listener.ServerConnection, bufferName
+	}
+	return listener.User.Networks[networkName], bufferName
+}
+
+// paramNetwork finds the network a command is for, given as its first param unless that's one of the
+// command's keywords and defaulting to the listener's network. The params after the network are returned
+func paramNetwork(listener *ircbnc.Listener, params []string, keywords ...string) (*ircbnc.ServerConnection, []string) {
+	if len(params) > 0 {
+		isKeyword := false
+		for _, keyword := range keywords {
+			isKeyword = isKeyword || strings.EqualFold(params[0], keyword)
+		}
+		if net, exists := listener.User.Networks[params[0]]; exists && !isKeyword {
+			return net, params[1:]
+		}
+	}
+	return listener.ServerConnection, params
+}
+
+func commandDetach(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		detached := []string{}
+		for _, network := range listener.User.Networks {
+			for _, buffer := range network.Buffers {
+				if !buffer.Detached {
+					continue
+				}
+				line := network.Name + "/" + buffer.Name
+				if buffer.Reattach != ircbnc.ReattachNever {
+					line += " (reattaches on " + buffer.Reattach + ")"
+				}
+				detached = append(detached, line)
+			}
+		}
+		sort.Strings(detached)
+
+		if len(detached) == 0 {
+			listener.SendStatus("You don't have any detached channels")
+		}
+		for _, line := range detached {
+			listener.SendStatus(line)
+		}
+		return
+	}
+
+	reattach := ircbnc.ReattachNever
+	if len(params) > 1 {
+		reattach = strings.ToLower(params[1])
+	}
+	if !ircbnc.IsValidReattach(reattach) {
+		listener.SendStatus("Usage: detach [<[network/]channel> [highlight|message]]")
+		return
+	}
+
+	net, bufferName := bufferNetwork(listener, params[0])
+	if net == nil {
+		listener.SendStatus("Name the network of the channel, as in <network>/<channel>")
+		return
+	}
+
+	if !net.DetachBuffer(bufferName, reattach) {
+		listener.SendStatus("You are not in " + bufferName + " on " + net.Name)
+		return
+	}
+
+	switch reattach {
+	case ircbnc.ReattachHighlight:
+		listener.SendStatus(bufferName + " is detached until it highlights you")
+	case ircbnc.ReattachMessage:
+		listener.SendStatus(bufferName + " is detached until someone talks in it")
+	default:
+		listener.SendStatus(bufferName + " is detached, send `attach " + net.Name + "/" + bufferName + "` to bring it back")
+	}
+}
+
+func commandAttach(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: attach <[network/]channel>")
+		return
+	}
+
+	net, bufferName := bufferNetwork(listener, params[0])
+	if net == nil {
+		listener.SendStatus("Name the network of the channel, as in <network>/<channel>")
+		return
+	}
+
+	if !net.AttachBuffer(bufferName) {
+		listener.SendStatus("You are not in " + bufferName + " on " + net.Name)
+		return
+	}
+	listener.SendStatus(bufferName + " is attached")
+}
+
+func commandRejoin(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	usage := "Usage: rejoin [network] [on|off|delay <seconds>|tries <count>|channel <[network/]channel> <on|off|default>]"
+
+	if len(params) >= 1 && strings.ToLower(params[0]) == "channel" {
+		if len(params) < 3 {
+			listener.SendStatus(usage)
+			return
+		}
+
+		net, bufferName := bufferNetwork(listener, params[1])
+		if net == nil {
+			listener.SendStatus("Name the network of the channel, as in <network>/<channel>")
+			return
+		}
+		buffer := net.Buffers.Get(bufferName)
+		if buffer == nil || !buffer.Channel {
+			listener.SendStatus("You are not in " + bufferName + " on " + net.Name)
+			return
+		}
+
+		switch strings.ToLower(params[2]) {
+		case ircbnc.RejoinOn, ircbnc.RejoinOff:
+			buffer.Rejoin = strings.ToLower(params[2])
+		case "default":
+			buffer.Rejoin = ircbnc.RejoinDefault
+		default:
+			listener.SendStatus(usage)
+			return
+		}
+
+		err := net.Save()
+		if err != nil {
+			listener.SendStatus("Could not save the channel's rejoin setting")
+		} else if net.ShouldRejoin(buffer) {
+			listener.SendStatus(buffer.Name + " will be rejoined after a kick")
+		} else {
+			listener.SendStatus(buffer.Name + " will not be rejoined after a kick")
+		}
+		return
+	}
+
+	net, params := paramNetwork(listener, params, "on", "off", "delay", "tries", "channel")
+	if net == nil {
+		listener.SendStatus("Name the network to change how it rejoins channels, as in rejoin <network>")
+		return
+	}
+
+	if len(params) < 1 {
+		if net.RejoinOnKick {
+			listener.SendStatus(fmt.Sprintf("Channels on %s are rejoined %s after a kick, trying %d times", net.Name, net.GetRejoinDelay().String(), net.GetRejoinTries()))
+		} else {
+			listener.SendStatus("Channels on " + net.Name + " are not rejoined after a kick")
+		}
+		for _, buffer := range net.Buffers {
+			if buffer.Channel && buffer.Rejoin != ircbnc.RejoinDefault {
+				listener.SendStatus(fmt.Sprintf("%s: rejoin %s", buffer.Name, buffer.Rejoin))
+			}
+		}
+		return
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "on", "off":
+		net.RejoinOnKick = strings.ToLower(params[0]) == "on"
+	case "delay", "tries":
+		if len(params) < 2 {
+			listener.SendStatus(usage)
+			return
+		}
+		value, err := strconv.Atoi(params[1])
+		if err != nil || value < 0 {
+			listener.SendStatus(usage)
+			return
+		}
+		if strings.ToLower(params[0]) == "delay" {
+			net.RejoinDelay = time.Duration(value) * time.Second
+		} else {
+			net.RejoinTries = value
+		}
+	default:
+		listener.SendStatus(usage)
+		return
+	}
+
+	err := net.Save()
+	if err != nil {
+		listener.SendStatus("Could not save your rejoin settings")
+	} else if net.RejoinOnKick {
+		listener.SendStatus(fmt.Sprintf("Channels on %s will be rejoined %s after a kick, trying %d times", net.Name, net.GetRejoinDelay().String(), net.GetRejoinTries()))
+	} else {
+		listener.SendStatus("Channels on " + net.Name + " will not be rejoined after a kick")
+	}
+}
+
+func commandInvite(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	net, params := paramNetwork(listener, params, "add", "del")
+	if net == nil {
+		listener.SendStatus("Name the network to change who can invite you on, as in invite <network>")
+		return
+	}
+
+	if len(params) < 1 {
+		if len(net.InviteAllow) == 0 {
+			listener.SendStatus("Invites on " + net.Name + " are not joined automatically")
+		}
+		for _, entry := range net.InviteAllow {
+			listener.SendStatus("Invites from " + entry + " are joined")
+		}
+		return
+	}
+
+	if len(params) < 2 {
+		listener.SendStatus("Usage: invite [network] [add|del <nick|account:<account>>]")
+		return
+	}
+
+	entry := params[1]
+	existing := -1
+	for i, allowed := range net.InviteAllow {
+		if strings.EqualFold(allowed, entry) {
+			existing = i
+		}
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "add":
+		if existing != -1 {
+			listener.SendStatus("Invites from " + entry + " are already joined")
+			return
+		}
+		net.InviteAllow = append(net.InviteAllow, entry)
+	case "del":
+		if existing == -1 {
+			listener.SendStatus(entry + " is not on your invite list")
+			return
+		}
+		net.InviteAllow = append(net.InviteAllow[:existing], net.InviteAllow[existing+1:]...)
+	default:
+		listener.SendStatus("Usage: invite [network] [add|del <nick|account:<account>>]")
+		return
+	}
+
+	err := net.Save()
+	if err != nil {
+		listener.SendStatus("Could not save your invite list")
+	} else if strings.ToLower(params[0]) == "add" {
+		listener.SendStatus("Invites from " + entry + " will be joined")
+	} else {
+		listener.SendStatus("Invites from " + entry + " will no longer be joined")
+	}
+}
+
+func commandListClients(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	clients := listener.User.GetClients()
+	if len(clients) == 0 {
+		listener.SendStatus("You haven't connected with any named clients. Name a client by logging in with <username>@<client>/<network>:<password>")
+		return
+	}
+
+	for _, client := range clients {
+		line := client.ID
+		if client.ID == listener.ClientID {
+			line += " (this client)"
+		}
+
+		if len(client.History) > 0 {
+			last := client.History[len(client.History)-1]
+			network := last.Network
+			if network == "" {
+				network = "no network"
+			}
+			line += fmt.Sprintf(": connected %s from %s to %s", formatStatusTime(listener.User, last.Connected), last.Address, network)
+			if last.Disconnected.IsZero() {
+				line += ", still connected"
+			} else {
+				line += ", disconnected " + formatStatusTime(listener.User, last.Disconnected)
+			}
+			line += fmt.Sprintf(", %d recent connections", len(client.History))
+		}
+
+		if client.PlaybackLimit > 0 {
+			line += fmt.Sprintf(", plays back %d messages", client.PlaybackLimit)
+		}
+		if client.PlaybackTimestamp != "" {
+			line += ", timestamp " + client.PlaybackTimestamp
+		}
+
+		listener.SendStatus(line)
+	}
+}
+
+func commandClient(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		listener.SendStatus("Usage: client <client> [playback <limit>|timestamp <format|default|off>|forget]")
+		return
+	}
+
+	clientID := strings.ToLower(params[0])
+	client := user.GetClient(clientID)
+	if client == nil {
+		listener.SendStatus("You haven't connected with a client named " + clientID)
+		return
+	}
+
+	if len(params) < 2 {
+		for _, connection := range client.History {
+			status := "still connected"
+			if !connection.Disconnected.IsZero() {
+				status = "until " + formatStatusTime(user, connection.Disconnected)
+			}
+			listener.SendStatus(fmt.Sprintf("%s: %s from %s to %s, %s", client.ID, formatStatusTime(user, connection.Connected), connection.Address, connection.Network, status))
+		}
+		listener.SendStatus(fmt.Sprintf("%s plays back up to %d messages per buffer", client.ID, clientPlaybackLimit(user, client)))
+		return
+	}
+
+	switch strings.ToLower(params[1]) {
+	case "forget":
+		user.ForgetClient(clientID)
+		for _, network := range user.Networks {
+			network.Save()
+		}
+
+	case "playback":
+		if len(params) < 3 {
+			listener.SendStatus("Usage: client <client> playback <limit>")
+			return
+		}
+		limit, err := strconv.Atoi(params[2])
+		if err != nil || limit < 0 {
+			listener.SendStatus("Limit must be a positive number, or 0 to use your default")
+			return
+		}
+		user.UpdateClient(clientID, func(client *ircbnc.UserClient) {
+			client.PlaybackLimit = limit
+		})
+
+	case "timestamp":
+		if len(params) < 3 {
+			listener.SendStatus("Usage: client <client> timestamp <format|default|off>")
+			return
+		}
+		format := strings.Join(params[2:], " ")
+		if strings.ToLower(format) == "default" {
+			format = ""
+		} else if strings.ToLower(format) == ircbnc.PlaybackTimestampOff {
+			format = ircbnc.PlaybackTimestampOff
+		}
+		user.UpdateClient(clientID, func(client *ircbnc.UserClient) {
+			client.PlaybackTimestamp = format
+		})
+
+	default:
+		listener.SendStatus("Usage: client <client> [playback <limit>|timestamp <format|default|off>|forget]")
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your clients")
+	} else {
+		listener.SendStatus("Updated client " + clientID)
+	}
+}
+
+func clientPlaybackLimit(user *ircbnc.User, client *ircbnc.UserClient) int {
+	if client.PlaybackLimit > 0 {
+		return client.PlaybackLimit
+	}
+	return user.GetPlaybackLimit()
+}
+
+// formatStatusTime formats a time in the user's timezone
+func formatStatusTime(user *ircbnc.User, ts time.Time) string {
+	location := user.Location()
+	if location == nil {
+		location = time.Local
+	}
+	return ts.In(location).Format("2006-01-02 15:04:05 MST")
+}
+
+func commandLogMode(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		mode := user.LogMode
+		if mode == ircbnc.LogModeDefault {
+			mode = ircbnc.LogModeAll
+		}
+		listener.SendStatus("Your log mode is " + mode)
+		return
+	}
+
+	mode := strings.ToLower(params[0])
+	if mode == "default" {
+		mode = ircbnc.LogModeDefault
+	}
+	if !ircbnc.IsValidLogMode(mode) {
+		listener.SendStatus("Usage: logmode [all|playback|none|default] [[network/]buffer]")
+		return
+	}
+
+	if len(params) < 2 {
+		user.LogMode = mode
+		err := listener.Manager.Ds.SaveUser(user)
+		if err != nil {
+			listener.SendStatus("Could not save your log mode")
+		} else {
+			listener.SendStatus("Log mode set to " + params[0])
+		}
+		return
+	}
+
+	net, bufferName := bufferNetwork(listener, params[1])
+	if net == nil {
+		listener.SendStatus("Name the network of the buffer, as in <network>/<buffer>")
+		return
+	}
+
+	buffer := net.Buffers.Get(bufferName)
+	if buffer == nil {
+		listener.SendStatus("Buffer " + bufferName + " not found")
+		return
+	}
+
+	buffer.LogMode = mode
+	err := listener.Manager.Ds.SaveConnection(net)
+	if err != nil {
+		listener.SendStatus("Could not save the log mode of " + buffer.Name)
+	} else {
+		listener.SendStatus("Log mode of " + buffer.Name + " set to " + params[0])
+	}
+}
+
+func commandEncryptLogs(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	user := listener.User
+
+	if len(params) < 1 {
+		if user.LogEncryptionEnabled() {
+			listener.SendStatus("Your stored messages are encrypted")
+		} else {
+			listener.SendStatus("Usage: encryptlogs <password>")
+		}
+		return
+	}
+
+	_, authSuccess := listener.Manager.Ds.AuthUser(user.Name, params[0])
+	if !authSuccess {
+		listener.SendStatus("Invalid password")
+		return
+	}
+
+	err := user.EnableLogEncryption(params[0])
+	if err != nil {
+		listener.SendStatus("Could not enable log encryption: " + err.Error())
+		return
+	}
+
+	err = listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your log key")
+		return
+	}
+
+	listener.UnlockLogKey(params[0])
+	listener.SendStatus("Your messages will now be encrypted when stored. Messages stored before now are not encrypted")
+}
+
+func commandPassword(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 2 {
+		listener.SendStatus("Usage: password <current password> <new password>")
+		return
+	}
+
+	user := listener.User
+	data := listener.Manager.Ds
+
+	_, authSuccess := data.AuthUser(user.Name, params[0])
+	if !authSuccess {
+		listener.SendStatus("Invalid password")
+		return
+	}
+
+	// The log key is wrapped with the password so it needs wrapping again
+	if user.LogEncryptionEnabled() {
+		err := user.RewrapLogKey(params[0], params[1])
+		if err != nil {
+			listener.SendStatus("Could not change your password: " + err.Error())
+			return
+		}
+	}
+
+	data.SetUserPassword(user, params[1])
+	err := data.SaveUser(user)
+	if err != nil {
+		listener.SendStatus("Could not save your new password")
+	} else {
+		listener.SendStatus("Password changed")
+	}
+}
+
+func commandExport(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: export <[network/]buffer> [jsonl|text|html] [from] [to]")
+		return
+	}
+
+	manager := listener.Manager
+	exportPath := manager.Config.Bouncer.ExportPath
+	if exportPath == "" {
+		listener.SendStatus("Exporting logs has not been enabled")
+		return
+	}
+	if manager.Messages == nil {
+		listener.SendStatus("Messages are not being stored")
+		return
+	}
+
+	net, bufferName := bufferNetwork(listener, params[0])
+	if net == nil {
+		listener.SendStatus("Name the network of the buffer, as in <network>/<buffer>")
+		return
+	}
+
+	user := listener.User
+	options := bncLogTools.ExportOptions{
+		UserID:    user.ID,
+		NetworkID: net.Name,
+		Buffer:    bufferName,
+		Format:    "text",
+		Location:  user.Location(),
+	}
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+
+	if len(params) > 1 {
+		options.Format = strings.ToLower(params[1])
+	}
+	extension, validFormat := bncLogTools.ExportFormats[options.Format]
+	if !validFormat {
+		listener.SendStatus("Unknown format " + params[1] + ", use jsonl, text or html")
+		return
+	}
+
+	var err error
+	if len(params) > 2 {
+		options.From, err = bncLogTools.ParseExportTime(params[2], options.Location)
+		if err != nil {
+			listener.SendStatus(err.Error())
+			return
+		}
+	}
+	if len(params) > 3 {
+		options.To, err = bncLogTools.ParseExportTime(params[3], options.Location)
+		if err != nil {
+			listener.SendStatus(err.Error())
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("%s-%s-%s.%s", net.Name, strings.ToLower(options.Buffer), time.Now().Format("20060102-150405"), extension)
+	filename = filepath.Join(exportPath, exportFilenamePart(user.ID), exportFilenamePart(filename))
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		listener.SendStatus("Could not create the export folder")
+		log.Println("Error creating export folder:", err.Error())
+		return
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		listener.SendStatus("Could not create the export file")
+		log.Println("Error creating export file:", err.Error())
+		return
+	}
+	defer file.Close()
+
+	count, err := bncLogTools.Export(manager.Messages, file, options)
+	if err != nil {
+		listener.SendStatus("Could not export messages: " + err.Error())
+		return
+	}
+
+	listener.SendStatus(fmt.Sprintf("Exported %d messages to %s", count, filename))
+}
+
+// exportFilenamePart makes sure a user supplied name can't leave the export folder
+func exportFilenamePart(name string) string {
+	name = strings.Map(func(char rune) rune {
+		if char == '/' || char == '\\' || char == 0 {
+			return '_'
+		}
+		return char
+	}, name)
+
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
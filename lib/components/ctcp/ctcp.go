@@ -0,0 +1,168 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentCtcp
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+)
+
+// answered lists the CTCPs we have a reply for without any configuration
+var answered = []string{"CLIENTINFO", "PING", "TIME", "VERSION"}
+
+func Run(manager *ircbnc.Manager) {
+	c := &Ctcp{
+		Manager:  manager,
+		answered: make(map[string][]time.Time),
+	}
+	c.RegisterHooks()
+}
+
+// Ctcp answers CTCPs on behalf of users that have no clients attached to a network,
+// leaving them to the clients when there are some
+type Ctcp struct {
+	Manager *ircbnc.Manager
+
+	// answered is when the latest CTCPs on each network were answered, for rate limiting
+	answered     map[string][]time.Time
+	answeredLock sync.Mutex
+}
+
+func (ctcp *Ctcp) RegisterHooks() {
+	ctcp.Manager.Bus.Register(ircbnc.HookIrcRawName, ctcp.onMessage)
+}
+
+func (ctcp *Ctcp) onMessage(hook interface{}) {
+	event := hook.(*ircbnc.HookIrcRaw)
+	if !event.FromServer || event.User == nil || event.Server == nil {
+		return
+	}
+
+	msg := event.Message
+	if msg.Command != "PRIVMSG" || len(msg.Params) < 2 {
+		return
+	}
+
+	command, param, isCtcp := ircbnc.SplitCtcp(msg.Params[1])
+	if !isCtcp || command == "ACTION" {
+		return
+	}
+
+	nick, _, _ := ircbnc.SplitMask(msg.Prefix)
+	if nick == "" || strings.Contains(nick, ".") || strings.EqualFold(nick, event.Server.Foo.Nick) {
+		return
+	}
+
+	// Attached clients answer for themselves
+	if hasListeners(event.Server) {
+		return
+	}
+
+	reply, shouldReply := ctcp.reply(event.User, command, param)
+	if !shouldReply || !ctcp.allow(event.User.ID+"/"+event.Server.Name) {
+		return
+	}
+
+	if reply == "" {
+		event.Server.Foo.WriteLine("NOTICE %s :\x01%s\x01", nick, command)
+	} else {
+		event.Server.Foo.WriteLine("NOTICE %s :\x01%s %s\x01", nick, command, reply)
+	}
+}
+
+// reply returns what a CTCP is answered with, or false if it isn't answered
+func (ctcp *Ctcp) reply(user *ircbnc.User, command string, param string) (string, bool) {
+	config := &ctcp.Manager.Config.Bouncer.Ctcp
+	reply, configured := config.Reply(command)
+	if configured {
+		// A blank reply stops the CTCP being answered, and pings always get their param back
+		if reply == "" {
+			return "", false
+		}
+		if command != "PING" {
+			return reply, true
+		}
+	}
+
+	switch command {
+	case "PING":
+		return param, true
+	case "VERSION":
+		return "GoshuBNC " + ircbnc.SemVer, true
+	case "TIME":
+		location := user.Location()
+		if location == nil {
+			location = time.Local
+		}
+		return time.Now().In(location).Format(time.RFC1123Z), true
+	case "CLIENTINFO":
+		return strings.Join(ctcp.clientInfo(), " "), true
+	}
+
+	return "", false
+}
+
+// clientInfo lists the CTCPs we answer
+func (ctcp *Ctcp) clientInfo() []string {
+	config := &ctcp.Manager.Config.Bouncer.Ctcp
+	commands := []string{"ACTION"}
+
+	for _, command := range answered {
+		if reply, configured := config.Reply(command); !configured || reply != "" {
+			commands = append(commands, command)
+		}
+	}
+	for command, reply := range config.Replies {
+		command = strings.ToUpper(command)
+		isAnswered := false
+		for _, existing := range commands {
+			isAnswered = isAnswered || existing == command
+		}
+		if reply != "" && !isAnswered {
+			commands = append(commands, command)
+		}
+	}
+
+	sort.Strings(commands)
+	return commands
+}
+
+// allow records a CTCP being answered on a network, returning false if too many have been lately
+func (ctcp *Ctcp) allow(network string) bool {
+	ctcp.answeredLock.Lock()
+	defer ctcp.answeredLock.Unlock()
+
+	cutoff := time.Now().Add(-time.Minute)
+	recent := []time.Time{}
+	for _, answered := range ctcp.answered[network] {
+		if answered.After(cutoff) {
+			recent = append(recent, answered)
+		}
+	}
+
+	if len(recent) >= ctcp.Manager.Config.Bouncer.Ctcp.GetRate() {
+		ctcp.answered[network] = recent
+		return false
+	}
+
+	ctcp.answered[network] = append(recent, time.Now())
+	return true
+}
+
+// hasListeners returns true if any clients are attached to the network
+func hasListeners(server *ircbnc.ServerConnection) bool {
+	server.ListenersLock.Lock()
+	defer server.ListenersLock.Unlock()
+
+	for _, listener := range server.Listeners {
+		if listener.Registered {
+			return true
+		}
+	}
+	return false
+}
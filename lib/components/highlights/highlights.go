@@ -0,0 +1,209 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentHighlights
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+)
+
+// How many missed mentions are shown when a client attaches
+const maxAttachSummary = 10
+
+func Run(manager *ircbnc.Manager) {
+	h := &Highlights{
+		Manager: manager,
+	}
+	h.RegisterHooks()
+}
+
+// Highlights watches messages for anything that highlights the user, keeping them in
+// a list of mentions that can be read back through the *highlights query
+type Highlights struct {
+	Manager *ircbnc.Manager
+}
+
+func (highlights *Highlights) RegisterHooks() {
+	highlights.Manager.Bus.Register(ircbnc.HookIrcRawName, highlights.onMessage)
+	highlights.Manager.Bus.Register(ircbnc.HookStateSentName, highlights.onStateSent)
+}
+
+func (highlights *Highlights) onMessage(hook interface{}) {
+	event := hook.(*ircbnc.HookIrcRaw)
+
+	if event.FromClient && event.Listener.Registered {
+		msg := event.Message
+		if msg.Command == "PRIVMSG" && len(msg.Params) > 1 && strings.EqualFold(msg.Params[0], ircbnc.HighlightsNick) {
+			event.Halt = true
+			highlights.handleQuery(event.Listener, msg.Params[1])
+		}
+		return
+	}
+
+	if event.FromServer && event.User != nil && event.Server != nil {
+		highlights.checkMessage(event)
+	}
+}
+
+// checkMessage records messages from the network that highlight the user
+func (highlights *Highlights) checkMessage(event *ircbnc.HookIrcRaw) {
+	msg := event.Message
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" || len(msg.Params) < 2 || msg.Prefix == "" {
+		return
+	}
+
+	nick, _, _ := ircbnc.SplitMask(msg.Prefix)
+	text := msg.Params[1]
+
+	// Actions are checked like any other message, but other CTCPs never highlight
+	if strings.HasPrefix(text, "\x01") {
+		if !strings.HasPrefix(text, "\x01ACTION ") {
+			return
+		}
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+	}
+
+	buffer := msg.Params[0]
+	if strings.EqualFold(buffer, event.Server.Foo.Nick) {
+		buffer = nick
+	}
+
+	if !event.User.IsHighlight(event.Server, buffer, nick, text) {
+		return
+	}
+
+	mention := &ircbnc.Mention{
+		Time:    time.Now().UTC(),
+		Network: event.Server.Name,
+		Buffer:  buffer,
+		Prefix:  msg.Prefix,
+		Command: msg.Command,
+		Text:    msg.Params[1],
+		Missed:  !event.User.IsAttached(),
+	}
+	err := event.User.AddMention(mention)
+	if err != nil {
+		log.Println("Error storing a mention of " + event.User.ID + ": " + err.Error())
+	}
+
+	event.User.Manager.Bus.Dispatch(ircbnc.HookHighlightName, &ircbnc.HookHighlight{
+		User:    event.User,
+		Server:  event.Server,
+		Mention: mention,
+	})
+}
+
+// Tell the user about anything that highlighted them while they were away
+func (highlights *Highlights) onStateSent(hook interface{}) {
+	event := hook.(*ircbnc.HookStateSent)
+	listener := event.Listener
+
+	missed, err := listener.User.TakeMissedMentions()
+	if err != nil {
+		log.Println("Error updating the mentions of " + listener.User.ID + ": " + err.Error())
+	}
+	if len(missed) == 0 {
+		return
+	}
+
+	plural := "s"
+	if len(missed) == 1 {
+		plural = ""
+	}
+	listener.Send(nil, highlightsSource(listener), "PRIVMSG", listener.ClientNick, fmt.Sprintf("You were mentioned %d time%s while you were away:", len(missed), plural))
+
+	shown := missed
+	if len(shown) > maxAttachSummary {
+		shown = shown[len(shown)-maxAttachSummary:]
+	}
+	for _, mention := range shown {
+		sendMention(listener, mention)
+	}
+	if len(missed) > len(shown) {
+		listener.Send(nil, highlightsSource(listener), "PRIVMSG", listener.ClientNick, fmt.Sprintf("%d more, send `list %d` to see them all", len(missed)-len(shown), len(missed)))
+	}
+}
+
+// handleQuery responds to messages sent to the *highlights query
+func (highlights *Highlights) handleQuery(listener *ircbnc.Listener, line string) {
+	params := strings.Fields(line)
+	command := "list"
+	if len(params) > 0 {
+		command = strings.ToLower(params[0])
+	}
+
+	reply := func(text string) {
+		listener.Send(nil, highlightsSource(listener), "PRIVMSG", listener.ClientNick, text)
+	}
+
+	switch command {
+	case "list":
+		count := 20
+		if len(params) > 1 {
+			parsed, err := strconv.Atoi(params[1])
+			if err != nil || parsed < 1 {
+				reply("Usage: list [count]")
+				return
+			}
+			count = parsed
+		}
+
+		mentions := listener.User.GetMentions()
+		if len(mentions) == 0 {
+			reply("You haven't been mentioned")
+			return
+		}
+		if len(mentions) > count {
+			mentions = mentions[len(mentions)-count:]
+		}
+		for _, mention := range mentions {
+			sendMention(listener, mention)
+		}
+
+	case "clear":
+		err := listener.User.ClearMentions()
+		if err != nil {
+			reply("Could not clear your mentions")
+		} else {
+			reply("Your mentions have been cleared")
+		}
+
+	default:
+		reply("Send `list [count]` to see your latest mentions, or `clear` to remove them")
+	}
+}
+
+func sendMention(listener *ircbnc.Listener, mention *ircbnc.Mention) {
+	message := mention.Message(listener.ClientNick)
+	message.Command = "PRIVMSG"
+	message.Prefix = highlightsSource(listener)
+
+	nick, _, _ := ircbnc.SplitMask(mention.Prefix)
+	text := mention.Text
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = "* " + nick + " " + strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+	} else {
+		text = "<" + nick + "> " + text
+	}
+	message.Params[1] = fmt.Sprintf("[%s] %s/%s %s", formatTime(listener.User, mention.Time), mention.Network, mention.Buffer, text)
+
+	listener.SendMessage(&message)
+}
+
+func highlightsSource(listener *ircbnc.Listener) string {
+	return fmt.Sprintf("%s!bnc@%s", ircbnc.HighlightsNick, listener.Manager.Source)
+}
+
+func formatTime(user *ircbnc.User, ts time.Time) string {
+	location := user.Location()
+	if location == nil {
+		location = time.Local
+	}
+	return ts.In(location).Format("2006-01-02 15:04")
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentLogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// KeyMessage stores a single message, keyed by user, network, buffer and then
+	// the time it was logged so that a buffer's messages sit together in time order
+	KeyMessage = "message %s %s %s %019d"
+	// KeyMessagePrefix is the start of every message key in a buffer
+	KeyMessagePrefix = "message %s %s %s "
+)
+
+// BuntdbMessage is how a message is stored in the database
+type BuntdbMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// BuntdbMessageDatastore stores messages in a buntdb database. Unlike the
+// sqlite logger it doesn't need cgo, so it works in static builds.
+type BuntdbMessageDatastore struct {
+	dbPath string
+	db     *buntdb.DB
+}
+
+func NewBuntdbMessageDatastore(config map[string]string) *BuntdbMessageDatastore {
+	ds := &BuntdbMessageDatastore{}
+
+	ds.dbPath = config["database"]
+	if ds.dbPath == "" {
+		log.Fatal("No database file has been configured for the buntdb message logger")
+	}
+
+	db, err := buntdb.Open(ds.dbPath)
+	if err != nil {
+		log.Fatal("Error opening messages buntdb database:", err.Error())
+	}
+	ds.db = db
+
+	return ds
+}
+
+func (ds *BuntdbMessageDatastore) SupportsStore() bool {
+	return true
+}
+func (ds *BuntdbMessageDatastore) SupportsRetrieve() bool {
+	return true
+}
+func (ds *BuntdbMessageDatastore) SupportsSearch() bool {
+	return true
+}
+
+// Close writes out the database and closes it
+func (ds *BuntdbMessageDatastore) Close() error {
+	return ds.db.Close()
+}
+
+func (ds *BuntdbMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
+	buffer, message := fileLogMessage(event)
+	if buffer == "" {
+		return
+	}
+
+	value, err := json.Marshal(BuntdbMessage{
+		Prefix:  message.Prefix,
+		Command: message.Command,
+		Params:  message.Params,
+	})
+	if err != nil {
+		log.Println("Error storing message:", err.Error())
+		return
+	}
+
+	ts := eventTime(event).UnixNano()
+	err = ds.db.Update(func(tx *buntdb.Tx) error {
+		// Messages logged within the same nanosecond get nudged along so that none are overwritten
+		for {
+			key := messageKey(event.User.ID, event.Server.Name, buffer, ts)
+			_, err := tx.Get(key)
+			if err == buntdb.ErrNotFound {
+				_, _, err = tx.Set(key, string(value), nil)
+				return err
+			} else if err != nil {
+				return err
+			}
+			ts++
+		}
+	})
+	if err != nil {
+		log.Println("Error storing message:", err.Error())
+	}
+}
+
+func (ds *BuntdbMessageDatastore) GetFromTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	prefix := messageKeyPrefix(userID, networkID, buffer)
+
+	ds.db.View(func(tx *buntdb.Tx) error {
+		from := messageKey(userID, networkID, buffer, timeFrom.UnixNano()+1)
+		return tx.AscendRange("", from, prefix+"~", func(key, value string) bool {
+			message, ok := buntdbMessage(prefix, key, value)
+			if ok {
+				messages = append(messages, message)
+			}
+			return len(messages) < num
+		})
+	})
+
+	return messages
+}
+func (ds *BuntdbMessageDatastore) GetBeforeTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	prefix := messageKeyPrefix(userID, networkID, buffer)
+
+	ds.db.View(func(tx *buntdb.Tx) error {
+		before := messageKey(userID, networkID, buffer, timeFrom.UnixNano()-1)
+		return tx.DescendRange("", before, prefix, func(key, value string) bool {
+			message, ok := buntdbMessage(prefix, key, value)
+			if ok {
+				messages = append(messages, message)
+			}
+			return len(messages) < num
+		})
+	})
+
+	// Reverse the messages so they're in order
+	for i := 0; i < len(messages)/2; i++ {
+		j := len(messages) - i - 1
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages
+}
+func (ds *BuntdbMessageDatastore) Search(userID string, networkID string, buffer string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	prefix := messageKeyPrefix(userID, networkID, buffer)
+
+	ds.db.View(func(tx *buntdb.Tx) error {
+		from := messageKey(userID, networkID, buffer, timeFrom.UnixNano())
+		to := messageKey(userID, networkID, buffer, timeTo.UnixNano()+1)
+		return tx.AscendRange("", from, to, func(key, value string) bool {
+			message, ok := buntdbMessage(prefix, key, value)
+			if ok {
+				messages = append(messages, message)
+			}
+			return len(messages) < num
+		})
+	})
+
+	return messages
+}
+
+// Prune removes the messages of the given user's network that fall outside the retention
+func (ds *BuntdbMessageDatastore) Prune(userID string, networkID string, retention ircbnc.MessageRetention) ircbnc.PruneStats {
+	stats := ircbnc.PruneStats{}
+
+	var cutoff int64
+	if retention.MaxAge > 0 {
+		cutoff = time.Now().Add(-retention.MaxAge).UnixNano()
+	}
+
+	type bufferState struct {
+		keptMessages int
+		keptBytes    uint64
+		limitHit     bool
+		pruned       bool
+	}
+	buffers := make(map[string]*bufferState)
+	toDelete := []string{}
+
+	networkPrefix := fmt.Sprintf("message %s %s ", messageKeyPart(userID), messageKeyPart(networkID))
+	ds.db.View(func(tx *buntdb.Tx) error {
+		// Walk from the newest message of each buffer backwards, collecting everything that needs to go
+		return tx.DescendKeys(networkPrefix+"*", func(key, value string) bool {
+			parts := strings.Split(strings.TrimPrefix(key, networkPrefix), " ")
+			if len(parts) != 2 {
+				return true
+			}
+			ts, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return true
+			}
+
+			state, exists := buffers[parts[0]]
+			if !exists {
+				state = &bufferState{}
+				buffers[parts[0]] = state
+			}
+
+			size := uint64(len(value))
+			tooOld := retention.MaxAge > 0 && ts < cutoff
+			overMessages := retention.MaxMessages > 0 && state.keptMessages+1 > retention.MaxMessages
+			overBytes := retention.MaxBytes > 0 && state.keptBytes+size > retention.MaxBytes
+			if overMessages || overBytes {
+				state.limitHit = true
+			}
+			if state.limitHit || tooOld {
+				toDelete = append(toDelete, key)
+				state.pruned = true
+				stats.Messages++
+				stats.Bytes += size
+				return true
+			}
+
+			state.keptMessages++
+			state.keptBytes += size
+			return true
+		})
+	})
+
+	if len(toDelete) == 0 {
+		return stats
+	}
+
+	err := ds.db.Update(func(tx *buntdb.Tx) error {
+		for _, key := range toDelete {
+			_, err := tx.Delete(key)
+			if err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Prune() error: " + err.Error())
+		return ircbnc.PruneStats{}
+	}
+
+	for _, state := range buffers {
+		if state.pruned {
+			stats.Buffers++
+		}
+	}
+
+	return stats
+}
+
+func messageKey(userID string, networkID string, buffer string, ts int64) string {
+	if ts < 0 {
+		ts = 0
+	}
+	return fmt.Sprintf(KeyMessage, messageKeyPart(userID), messageKeyPart(networkID), messageKeyPart(strings.ToLower(buffer)), ts)
+}
+
+func messageKeyPrefix(userID string, networkID string, buffer string) string {
+	return fmt.Sprintf(KeyMessagePrefix, messageKeyPart(userID), messageKeyPart(networkID), messageKeyPart(strings.ToLower(buffer)))
+}
+
+// messageKeyPart escapes the key separator along with anything buntdb treats as a pattern
+func messageKeyPart(part string) string {
+	replacer := strings.NewReplacer(
+		"%", "%25",
+		" ", "%20",
+		"*", "%2A",
+		"?", "%3F",
+	)
+	return replacer.Replace(part)
+}
+
+// buntdbMessage converts a stored message back into an IRC message
+func buntdbMessage(prefix string, key string, value string) (*ircmsg.IrcMessage, bool) {
+	ts, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	stored := BuntdbMessage{}
+	err = json.Unmarshal([]byte(value), &stored)
+	if err != nil {
+		log.Println("Error reading stored message:", err.Error())
+		return nil, false
+	}
+
+	tags := make(map[string]ircmsg.TagValue)
+	tags["time"] = ircmsg.MakeTagValue(time.Unix(0, ts).UTC().Format(time.RFC3339))
+
+	message := ircmsg.MakeMessage(&tags, stored.Prefix, stored.Command, stored.Params...)
+	return &message, true
+}
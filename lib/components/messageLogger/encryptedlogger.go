@@ -0,0 +1,118 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentLogger
+
+import (
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// EncryptedMessageDatastore encrypts message text for users that have enabled
+// log encryption before handing messages to the wrapped store, and decrypts
+// them again when they're read back.
+type EncryptedMessageDatastore struct {
+	manager *ircbnc.Manager
+	store   ircbnc.MessageDatastore
+}
+
+func NewEncryptedMessageDatastore(manager *ircbnc.Manager, store ircbnc.MessageDatastore) *EncryptedMessageDatastore {
+	return &EncryptedMessageDatastore{
+		manager: manager,
+		store:   store,
+	}
+}
+
+func (ds *EncryptedMessageDatastore) SupportsStore() bool {
+	return ds.store.SupportsStore()
+}
+func (ds *EncryptedMessageDatastore) SupportsRetrieve() bool {
+	return ds.store.SupportsRetrieve()
+}
+func (ds *EncryptedMessageDatastore) SupportsSearch() bool {
+	return ds.store.SupportsSearch()
+}
+
+func (ds *EncryptedMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
+	command := event.Message.Command
+	params := event.Message.Params
+	if !event.User.LogEncryptionEnabled() || (command != "PRIVMSG" && command != "NOTICE") || len(params) < 2 {
+		ds.store.Store(event)
+		return
+	}
+
+	text, err := event.User.EncryptLogText(params[len(params)-1])
+	if err != nil {
+		// Never fall back to storing the plaintext
+		log.Println("Error encrypting message:", err.Error())
+		return
+	}
+
+	// Other hooks still need the original message so only the stored copy gets changed
+	encrypted := *event
+	encrypted.Message.Params = make([]string, len(params))
+	copy(encrypted.Message.Params, params)
+	encrypted.Message.Params[len(params)-1] = text
+
+	ds.store.Store(&encrypted)
+}
+
+func (ds *EncryptedMessageDatastore) GetFromTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	return ds.decrypt(userID, ds.store.GetFromTime(userID, networkID, buffer, timeFrom, num))
+}
+func (ds *EncryptedMessageDatastore) GetBeforeTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	return ds.decrypt(userID, ds.store.GetBeforeTime(userID, networkID, buffer, timeFrom, num))
+}
+func (ds *EncryptedMessageDatastore) Search(userID string, networkID string, buffer string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage {
+	return ds.decrypt(userID, ds.store.Search(userID, networkID, buffer, timeFrom, timeTo, num))
+}
+
+// decrypt decrypts the given messages, dropping any that can't be decrypted
+func (ds *EncryptedMessageDatastore) decrypt(userID string, messages []*ircmsg.IrcMessage) []*ircmsg.IrcMessage {
+	user := ds.manager.Users[userID]
+	decrypted := []*ircmsg.IrcMessage{}
+
+	for _, message := range messages {
+		last := len(message.Params) - 1
+		if last < 0 || !strings.HasPrefix(message.Params[last], ircbnc.EncryptedLogPrefix) {
+			decrypted = append(decrypted, message)
+			continue
+		}
+
+		if user == nil {
+			continue
+		}
+		text, ok := user.DecryptLogText(message.Params[last])
+		if !ok {
+			continue
+		}
+
+		message.Params[last] = text
+		decrypted = append(decrypted, message)
+	}
+
+	return decrypted
+}
+
+// Prune prunes the wrapped store if it supports it
+func (ds *EncryptedMessageDatastore) Prune(userID string, networkID string, retention ircbnc.MessageRetention) ircbnc.PruneStats {
+	pruner, canPrune := ds.store.(ircbnc.MessagePruner)
+	if !canPrune {
+		return ircbnc.PruneStats{}
+	}
+	return pruner.Prune(userID, networkID, retention)
+}
+
+// Close closes the wrapped store if it needs it
+func (ds *EncryptedMessageDatastore) Close() error {
+	closer, canClose := ds.store.(io.Closer)
+	if !canClose {
+		return nil
+	}
+	return closer.Close()
+}
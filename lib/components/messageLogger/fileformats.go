@@ -0,0 +1,352 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentLogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// logFormat converts messages to and from lines in a log file.
+// Parse doesn't need to recover the timestamp as the log index holds a more accurate one.
+type logFormat interface {
+	Format(ts time.Time, message *ircmsg.IrcMessage) string
+	Parse(line string, buffer string) (ircmsg.IrcMessage, bool)
+}
+
+var fileLogFormats = map[string]logFormat{
+	"text":    textLogFormat{},
+	"jsonl":   jsonLogFormat{},
+	"irssi":   irssiLogFormat{},
+	"weechat": weechatLogFormat{},
+}
+
+// messageText returns the text of a PRIVMSG/NOTICE and whether it's a CTCP ACTION
+func messageText(message *ircmsg.IrcMessage) (string, bool) {
+	text := message.Params[1]
+	if message.Command == "PRIVMSG" && strings.HasPrefix(text, "\x01ACTION") {
+		action := strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION"), "\x01")
+		return strings.TrimPrefix(action, " "), true
+	}
+
+	return text, false
+}
+
+func makeActionText(action string) string {
+	return "\x01ACTION " + action + "\x01"
+}
+
+func paramOrEmpty(message *ircmsg.IrcMessage, idx int) string {
+	if len(message.Params) > idx {
+		return message.Params[idx]
+	}
+	return ""
+}
+
+/**
+ * Format: text
+ * [2017-01-02 15:04:05] <nick> message
+ * [2017-01-02 15:04:05] -nick- notice
+ * [2017-01-02 15:04:05] * nick action
+ * [2017-01-02 15:04:05] *** nick!user@host has joined #channel
+ */
+
+var (
+	textLineMessage = regexp.MustCompile(`^<([^ ]+)> (.*)$`)
+	textLineNotice  = regexp.MustCompile(`^-([^ ]+)- (.*)$`)
+	textLineAction  = regexp.MustCompile(`^\* ([^ ]+) (.*)$`)
+	textLineJoin    = regexp.MustCompile(`^\*\*\* ([^ ]+) has joined ([^ ]+)$`)
+	textLinePart    = regexp.MustCompile(`^\*\*\* ([^ ]+) has left ([^ ]+)(?: \((.*)\))?$`)
+	textLineKick    = regexp.MustCompile(`^\*\*\* ([^ ]+) has been kicked from ([^ ]+) by ([^ ]+) \((.*)\)$`)
+)
+
+type textLogFormat struct{}
+
+func (textLogFormat) Format(ts time.Time, message *ircmsg.IrcMessage) string {
+	line := ""
+	params := message.Params
+
+	switch message.Command {
+	case "PRIVMSG":
+		text, isAction := messageText(message)
+		if isAction {
+			line = fmt.Sprintf("* %s %s", message.Prefix, text)
+		} else {
+			line = fmt.Sprintf("<%s> %s", message.Prefix, text)
+		}
+	case "NOTICE":
+		line = fmt.Sprintf("-%s- %s", message.Prefix, params[1])
+	case "JOIN":
+		line = fmt.Sprintf("*** %s has joined %s", message.Prefix, params[0])
+	case "PART":
+		line = fmt.Sprintf("*** %s has left %s", message.Prefix, params[0])
+		if len(params) > 1 {
+			line += fmt.Sprintf(" (%s)", params[1])
+		}
+	case "KICK":
+		line = fmt.Sprintf("*** %s has been kicked from %s by %s (%s)", params[1], params[0], message.Prefix, paramOrEmpty(message, 2))
+	}
+
+	return fmt.Sprintf("[%s] %s", ts.Format("2006-01-02 15:04:05"), line)
+}
+
+func (textLogFormat) Parse(line string, buffer string) (ircmsg.IrcMessage, bool) {
+	pos := strings.Index(line, "] ")
+	if !strings.HasPrefix(line, "[") || pos == -1 {
+		return ircmsg.IrcMessage{}, false
+	}
+	line = line[pos+2:]
+
+	if m := textLineJoin.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[1], "JOIN", m[2]), true
+	}
+	if m := textLinePart.FindStringSubmatch(line); m != nil {
+		if m[3] != "" {
+			return ircmsg.MakeMessage(nil, m[1], "PART", m[2], m[3]), true
+		}
+		return ircmsg.MakeMessage(nil, m[1], "PART", m[2]), true
+	}
+	if m := textLineKick.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[3], "KICK", m[2], m[1], m[4]), true
+	}
+	if m := textLineMessage.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, m[2]), true
+	}
+	if m := textLineNotice.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[1], "NOTICE", buffer, m[2]), true
+	}
+	if m := textLineAction.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, makeActionText(m[2])), true
+	}
+
+	return ircmsg.IrcMessage{}, false
+}
+
+/**
+ * Format: jsonl
+ * One JSON object per line, keeping the full message so nothing is lost.
+ * {"time":"2017-01-02T15:04:05.123+00:00","prefix":"nick!user@host","command":"PRIVMSG","params":["#channel","message"]}
+ */
+
+type jsonLogLine struct {
+	Time    string   `json:"time"`
+	Prefix  string   `json:"prefix"`
+	Nick    string   `json:"nick"`
+	Command string   `json:"command"`
+	Params  []string `json:"params"`
+}
+
+type jsonLogFormat struct{}
+
+func (jsonLogFormat) Format(ts time.Time, message *ircmsg.IrcMessage) string {
+	nick, _, _ := ircbnc.SplitMask(message.Prefix)
+	lineBytes, err := json.Marshal(jsonLogLine{
+		Time:    ts.Format(time.RFC3339Nano),
+		Prefix:  message.Prefix,
+		Nick:    nick,
+		Command: message.Command,
+		Params:  message.Params,
+	})
+	if err != nil {
+		return ""
+	}
+
+	return string(lineBytes)
+}
+
+func (jsonLogFormat) Parse(line string, buffer string) (ircmsg.IrcMessage, bool) {
+	logLine := &jsonLogLine{}
+	err := json.Unmarshal([]byte(line), logLine)
+	if err != nil || logLine.Command == "" {
+		return ircmsg.IrcMessage{}, false
+	}
+
+	return ircmsg.MakeMessage(nil, logLine.Prefix, logLine.Command, logLine.Params...), true
+}
+
+/**
+ * Format: irssi
+ * 15:04 <nick> message
+ * 15:04  * nick action
+ * 15:04 -nick- notice
+ * 15:04 -!- nick [user@host] has joined #channel
+ */
+
+var (
+	irssiLineMessage = regexp.MustCompile(`^[0-9:]+ <([^ ]+)> (.*)$`)
+	irssiLineAction  = regexp.MustCompile(`^[0-9:]+  \* ([^ ]+) (.*)$`)
+	irssiLineNotice  = regexp.MustCompile(`^[0-9:]+ -([^ ]+)- (.*)$`)
+	irssiLineJoin    = regexp.MustCompile(`^[0-9:]+ -!- ([^ ]+) \[([^ ]*)\] has joined ([^ ]+)$`)
+	irssiLinePart    = regexp.MustCompile(`^[0-9:]+ -!- ([^ ]+) \[([^ ]*)\] has left ([^ ]+) \[(.*)\]$`)
+	irssiLineKick    = regexp.MustCompile(`^[0-9:]+ -!- ([^ ]+) was kicked from ([^ ]+) by ([^ ]+) \[(.*)\]$`)
+)
+
+type irssiLogFormat struct{}
+
+func (irssiLogFormat) Format(ts time.Time, message *ircmsg.IrcMessage) string {
+	line := ""
+	params := message.Params
+	nick, username, host := ircbnc.SplitMask(message.Prefix)
+	userhost := ""
+	if username != "" || host != "" {
+		userhost = username + "@" + host
+	}
+
+	switch message.Command {
+	case "PRIVMSG":
+		text, isAction := messageText(message)
+		if isAction {
+			line = fmt.Sprintf(" * %s %s", nick, text)
+		} else {
+			line = fmt.Sprintf("<%s> %s", nick, text)
+		}
+	case "NOTICE":
+		line = fmt.Sprintf("-%s- %s", nick, params[1])
+	case "JOIN":
+		line = fmt.Sprintf("-!- %s [%s] has joined %s", nick, userhost, params[0])
+	case "PART":
+		line = fmt.Sprintf("-!- %s [%s] has left %s [%s]", nick, userhost, params[0], paramOrEmpty(message, 1))
+	case "KICK":
+		line = fmt.Sprintf("-!- %s was kicked from %s by %s [%s]", params[1], params[0], nick, paramOrEmpty(message, 2))
+	}
+
+	return ts.Format("15:04") + " " + line
+}
+
+func (irssiLogFormat) Parse(line string, buffer string) (ircmsg.IrcMessage, bool) {
+	if m := irssiLineJoin.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, joinMask(m[1], m[2]), "JOIN", m[3]), true
+	}
+	if m := irssiLinePart.FindStringSubmatch(line); m != nil {
+		if m[4] != "" {
+			return ircmsg.MakeMessage(nil, joinMask(m[1], m[2]), "PART", m[3], m[4]), true
+		}
+		return ircmsg.MakeMessage(nil, joinMask(m[1], m[2]), "PART", m[3]), true
+	}
+	if m := irssiLineKick.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[3], "KICK", m[2], m[1], m[4]), true
+	}
+	if m := irssiLineMessage.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, m[2]), true
+	}
+	if m := irssiLineAction.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, makeActionText(m[2])), true
+	}
+	if m := irssiLineNotice.FindStringSubmatch(line); m != nil {
+		return ircmsg.MakeMessage(nil, m[1], "NOTICE", buffer, m[2]), true
+	}
+
+	return ircmsg.IrcMessage{}, false
+}
+
+/**
+ * Format: weechat
+ * Tab separated date, prefix and message.
+ * 2017-01-02 15:04:05	nick	message
+ * 2017-01-02 15:04:05	 *	nick action
+ * 2017-01-02 15:04:05	-->	nick (user@host) has joined #channel
+ */
+
+var (
+	weechatLineJoin   = regexp.MustCompile(`^([^ ]+) \(([^ ]*)\) has joined ([^ ]+)$`)
+	weechatLinePart   = regexp.MustCompile(`^([^ ]+) \(([^ ]*)\) has left ([^ ]+)(?: \((.*)\))?$`)
+	weechatLineKick   = regexp.MustCompile(`^([^ ]+) has kicked ([^ ]+) from ([^ ]+)(?: \((.*)\))?$`)
+	weechatLineNotice = regexp.MustCompile(`^Notice\(([^ ]+)\): (.*)$`)
+	weechatLineAction = regexp.MustCompile(`^([^ ]+) (.*)$`)
+)
+
+type weechatLogFormat struct{}
+
+func (weechatLogFormat) Format(ts time.Time, message *ircmsg.IrcMessage) string {
+	prefix := ""
+	line := ""
+	params := message.Params
+	nick, username, host := ircbnc.SplitMask(message.Prefix)
+	userhost := ""
+	if username != "" || host != "" {
+		userhost = username + "@" + host
+	}
+
+	switch message.Command {
+	case "PRIVMSG":
+		text, isAction := messageText(message)
+		if isAction {
+			prefix = " *"
+			line = fmt.Sprintf("%s %s", nick, text)
+		} else {
+			prefix = nick
+			line = text
+		}
+	case "NOTICE":
+		prefix = "--"
+		line = fmt.Sprintf("Notice(%s): %s", nick, params[1])
+	case "JOIN":
+		prefix = "-->"
+		line = fmt.Sprintf("%s (%s) has joined %s", nick, userhost, params[0])
+	case "PART":
+		prefix = "<--"
+		line = fmt.Sprintf("%s (%s) has left %s", nick, userhost, params[0])
+		if len(params) > 1 {
+			line += fmt.Sprintf(" (%s)", params[1])
+		}
+	case "KICK":
+		prefix = "<--"
+		line = fmt.Sprintf("%s has kicked %s from %s (%s)", nick, params[1], params[0], paramOrEmpty(message, 2))
+	}
+
+	return ts.Format("2006-01-02 15:04:05") + "\t" + prefix + "\t" + line
+}
+
+func (weechatLogFormat) Parse(line string, buffer string) (ircmsg.IrcMessage, bool) {
+	parts := strings.SplitN(line, "\t", 3)
+	if len(parts) != 3 {
+		return ircmsg.IrcMessage{}, false
+	}
+	prefix, line := parts[1], parts[2]
+
+	switch prefix {
+	case "-->":
+		if m := weechatLineJoin.FindStringSubmatch(line); m != nil {
+			return ircmsg.MakeMessage(nil, joinMask(m[1], m[2]), "JOIN", m[3]), true
+		}
+	case "<--":
+		if m := weechatLineKick.FindStringSubmatch(line); m != nil {
+			return ircmsg.MakeMessage(nil, m[1], "KICK", m[3], m[2], m[4]), true
+		}
+		if m := weechatLinePart.FindStringSubmatch(line); m != nil {
+			if m[4] != "" {
+				return ircmsg.MakeMessage(nil, joinMask(m[1], m[2]), "PART", m[3], m[4]), true
+			}
+			return ircmsg.MakeMessage(nil, joinMask(m[1], m[2]), "PART", m[3]), true
+		}
+	case "--":
+		if m := weechatLineNotice.FindStringSubmatch(line); m != nil {
+			return ircmsg.MakeMessage(nil, m[1], "NOTICE", buffer, m[2]), true
+		}
+	case " *":
+		if m := weechatLineAction.FindStringSubmatch(line); m != nil {
+			return ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, makeActionText(m[2])), true
+		}
+	default:
+		if prefix != "" && !strings.Contains(prefix, " ") {
+			return ircmsg.MakeMessage(nil, prefix, "PRIVMSG", buffer, line), true
+		}
+	}
+
+	return ircmsg.IrcMessage{}, false
+}
+
+// joinMask puts a nick and user@host pair back together into a full mask
+func joinMask(nick string, userhost string) string {
+	if userhost == "" {
+		return nick
+	}
+	return nick + "!" + userhost
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentLogger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Every dated log file has an index file next to it. The index holds one
+ * fixed size record per logged line containing the time the line was logged
+ * and the byte offset of the line within the log file. Records are appended
+ * in time order so a lookup is a binary search + a seek instead of a scan.
+ */
+
+const fileIndexRecordSize = 16
+
+type fileIndexRecord struct {
+	ts     int64
+	offset int64
+}
+
+func (record fileIndexRecord) Time() time.Time {
+	return time.Unix(0, record.ts).UTC()
+}
+
+type fileIndex []fileIndexRecord
+
+func appendFileIndexRecord(filename string, ts time.Time, offset int64) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, fileIndexRecordSize)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(offset))
+	_, err = f.Write(buf)
+	return err
+}
+
+// writeFileIndex replaces the index file with the given records
+func writeFileIndex(filename string, index fileIndex) error {
+	buf := make([]byte, 0, len(index)*fileIndexRecordSize)
+	record := make([]byte, fileIndexRecordSize)
+	for _, entry := range index {
+		binary.BigEndian.PutUint64(record[0:8], uint64(entry.ts))
+		binary.BigEndian.PutUint64(record[8:16], uint64(entry.offset))
+		buf = append(buf, record...)
+	}
+
+	return replaceFile(filename, buf)
+}
+
+// replaceFile atomically replaces the contents of the given file
+func replaceFile(filename string, data []byte) error {
+	tmpFilename := filename + ".tmp"
+	err := ioutil.WriteFile(tmpFilename, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, filename)
+}
+
+func loadFileIndex(filename string) (fileIndex, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := fileIndex{}
+	reader := bufio.NewReader(f)
+	buf := make([]byte, fileIndexRecordSize)
+	for {
+		_, err := io.ReadFull(reader, buf)
+		if err != nil {
+			// A partially written record at the end of the file is ignored
+			break
+		}
+
+		index = append(index, fileIndexRecord{
+			ts:     int64(binary.BigEndian.Uint64(buf[0:8])),
+			offset: int64(binary.BigEndian.Uint64(buf[8:16])),
+		})
+	}
+
+	return index, nil
+}
+
+// lastFileIndexRecord returns the newest record in the index file, if there is one
+func lastFileIndexRecord(filename string) (fileIndexRecord, bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fileIndexRecord{}, false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fileIndexRecord{}, false
+	}
+
+	// Ignore any partially written record at the end of the file
+	size := info.Size() - info.Size()%fileIndexRecordSize
+	if size == 0 {
+		return fileIndexRecord{}, false
+	}
+
+	buf := make([]byte, fileIndexRecordSize)
+	_, err = f.ReadAt(buf, size-fileIndexRecordSize)
+	if err != nil {
+		return fileIndexRecord{}, false
+	}
+
+	return fileIndexRecord{
+		ts:     int64(binary.BigEndian.Uint64(buf[0:8])),
+		offset: int64(binary.BigEndian.Uint64(buf[8:16])),
+	}, true
+}
+
+// insertLogLine inserts a line into a log file in time order, rewriting the log and its index
+func insertLogLine(filename string, ts time.Time, line string) error {
+	indexName := indexFilename(filename)
+	index, err := loadFileIndex(indexName)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	pos := index.firstAfter(ts)
+	offset := int64(len(data))
+	if pos < len(index) {
+		offset = index[pos].offset
+	}
+	if offset > int64(len(data)) {
+		return io.ErrUnexpectedEOF
+	}
+
+	lineBytes := []byte(line + "\n")
+	newData := make([]byte, 0, len(data)+len(lineBytes))
+	newData = append(newData, data[:offset]...)
+	newData = append(newData, lineBytes...)
+	newData = append(newData, data[offset:]...)
+
+	newIndex := make(fileIndex, 0, len(index)+1)
+	newIndex = append(newIndex, index[:pos]...)
+	newIndex = append(newIndex, fileIndexRecord{
+		ts:     ts.UnixNano(),
+		offset: offset,
+	})
+	for _, record := range index[pos:] {
+		record.offset += int64(len(lineBytes))
+		newIndex = append(newIndex, record)
+	}
+
+	err = replaceFile(filename, newData)
+	if err != nil {
+		return err
+	}
+	return writeFileIndex(indexName, newIndex)
+}
+
+// firstAfter returns the position of the first record logged after the given time
+func (index fileIndex) firstAfter(t time.Time) int {
+	ts := t.UnixNano()
+	return sort.Search(len(index), func(i int) bool {
+		return index[i].ts > ts
+	})
+}
+
+// firstFrom returns the position of the first record logged at or after the given time
+func (index fileIndex) firstFrom(t time.Time) int {
+	ts := t.UnixNano()
+	return sort.Search(len(index), func(i int) bool {
+		return index[i].ts >= ts
+	})
+}
+
+// readIndexedLines reads the log lines for the given index records out of the log file
+func readIndexedLines(filename string, records []fileIndexRecord) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	for _, record := range records {
+		_, err := f.Seek(record.offset, io.SeekStart)
+		if err != nil {
+			return lines, err
+		}
+
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return lines, err
+		}
+
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+
+	return lines, nil
+}
@@ -4,18 +4,38 @@
 package bncComponentLogger
 
 import (
-	"fmt"
+	"errors"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/goshuirc/bnc/lib"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
+const (
+	fileLogDateFormat = "2006-01-02"
+	// Every log file has its index stored alongside it as <name>.idx
+	defaultFileLogTemplate = "{user}/{network}/{buffer}/{date}.log"
+
+	// Timezones range from UTC-12 to UTC+14 so a log file dated in any of them
+	// can hold messages up to this far either side of that date in UTC
+	maxTimezoneOffset = 14 * time.Hour
+)
+
+var errLogPathEscaped = errors.New("Log filename is outside of the log folder")
+
 type FileMessageDatastore struct {
-	logPath string
+	logPath  string
+	template string
+	format   logFormat
+	location *time.Location
+	// writeLock keeps a log line and its index record together
+	writeLock sync.Mutex
 }
 
 func NewFileMessageDatastore(config map[string]string) *FileMessageDatastore {
@@ -26,6 +46,35 @@ func NewFileMessageDatastore(config map[string]string) *FileMessageDatastore {
 		ds.logPath += "/"
 	}
 
+	ds.template = config["template"]
+	if ds.template == "" {
+		ds.template = defaultFileLogTemplate
+	} else if !strings.Contains(ds.template, "{date}") {
+		log.Println("File logger template must contain {date}, using the default template instead")
+		ds.template = defaultFileLogTemplate
+	}
+
+	formatName := config["format"]
+	if formatName == "" {
+		formatName = "text"
+	}
+	format, exists := fileLogFormats[formatName]
+	if !exists {
+		log.Println("Unknown file logger format " + formatName + ", using text instead")
+		format = fileLogFormats["text"]
+	}
+	ds.format = format
+
+	ds.location = time.Local
+	if config["timezone"] != "" {
+		location, err := time.LoadLocation(config["timezone"])
+		if err != nil {
+			log.Println("Unknown file logger timezone: " + err.Error())
+		} else {
+			ds.location = location
+		}
+	}
+
 	return ds
 }
 
@@ -33,10 +82,10 @@ func (ds *FileMessageDatastore) SupportsStore() bool {
 	return true
 }
 func (ds *FileMessageDatastore) SupportsRetrieve() bool {
-	return false
+	return true
 }
 func (ds *FileMessageDatastore) SupportsSearch() bool {
-	return false
+	return true
 }
 
 func (ds *FileMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
@@ -44,86 +93,342 @@ func (ds *FileMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
 		return
 	}
 
-	line, destination := createLineFromMessage(event)
-	if line == "" || destination == "" {
+	buffer, message := fileLogMessage(event)
+	if buffer == "" {
+		return
+	}
+
+	// Log files rotate daily in the timezone of the user
+	location := event.User.Location()
+	if location == nil {
+		location = ds.location
+	}
+	now := eventTime(event).In(location)
+
+	line := ds.format.Format(now, &message)
+	if line == "" {
+		return
+	}
+
+	filename, err := ds.logFilename(event.User.ID, event.Server.Name, buffer, now.Format(fileLogDateFormat))
+	if err != nil {
+		log.Println("Error building log filename:", err.Error())
 		return
 	}
 
 	// Make sure the chat directly exists
-	logPath := filepath.Join(ds.logPath, event.User.ID, event.Server.Name)
-	os.MkdirAll(logPath, os.ModePerm)
-	filename := filepath.Join(logPath, destination+".log")
+	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+
+	ds.writeLock.Lock()
+	defer ds.writeLock.Unlock()
+
+	// Imported messages can be older than what's already logged, which needs the log rewriting to keep it in order
+	last, hasLast := lastFileIndexRecord(indexFilename(filename))
+	if hasLast && now.UnixNano() < last.ts {
+		err = insertLogLine(filename, now, line)
+		if err != nil {
+			log.Println("Error writing log file:", err.Error())
+		}
+		return
+	}
 
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		println(err.Error())
+		log.Println("Error opening log file:", err.Error())
 		return
 	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Println("Error reading log file:", err.Error())
+		return
+	}
+
+	_, err = f.WriteString(line + "\n")
+	if err != nil {
+		log.Println("Error writing log file:", err.Error())
+		return
+	}
+
+	err = appendFileIndexRecord(indexFilename(filename), now, info.Size())
+	if err != nil {
+		log.Println("Error writing log index:", err.Error())
+	}
+}
+
+func (ds *FileMessageDatastore) GetFromTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	firstDay := timeFrom.UTC().Add(-maxTimezoneOffset).Format(fileLogDateFormat)
+
+	for _, logFile := range ds.logFiles(userID, networkID, buffer) {
+		if len(messages) >= num {
+			break
+		}
+		if logFile.day < firstDay {
+			continue
+		}
+
+		index, err := loadFileIndex(indexFilename(logFile.filename))
+		if err != nil {
+			continue
+		}
+
+		start := index.firstAfter(timeFrom)
+		end := start + num - len(messages)
+		if end > len(index) {
+			end = len(index)
+		}
+
+		messages = append(messages, ds.readLogMessages(logFile.filename, buffer, index[start:end])...)
+	}
+
+	return messages
+}
+func (ds *FileMessageDatastore) GetBeforeTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	lastDay := timeFrom.UTC().Add(maxTimezoneOffset).Format(fileLogDateFormat)
+
+	logFiles := ds.logFiles(userID, networkID, buffer)
+	for i := len(logFiles) - 1; i >= 0; i-- {
+		if len(messages) >= num {
+			break
+		}
+		if logFiles[i].day > lastDay {
+			continue
+		}
+
+		index, err := loadFileIndex(indexFilename(logFiles[i].filename))
+		if err != nil {
+			continue
+		}
+
+		end := index.firstFrom(timeFrom)
+		start := end - (num - len(messages))
+		if start < 0 {
+			start = 0
+		}
+
+		messages = append(ds.readLogMessages(logFiles[i].filename, buffer, index[start:end]), messages...)
+	}
 
-	f.WriteString(line + "\n")
-	f.Close()
+	return messages
 }
-func (ds *FileMessageDatastore) GetFromTime(string, string, string, time.Time, int) []*ircmsg.IrcMessage {
-	return []*ircmsg.IrcMessage{}
+func (ds *FileMessageDatastore) Search(userID string, networkID string, buffer string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	firstDay := timeFrom.UTC().Add(-maxTimezoneOffset).Format(fileLogDateFormat)
+	lastDay := timeTo.UTC().Add(maxTimezoneOffset).Format(fileLogDateFormat)
+
+	for _, logFile := range ds.logFiles(userID, networkID, buffer) {
+		if len(messages) >= num || logFile.day > lastDay {
+			break
+		}
+		if logFile.day < firstDay {
+			continue
+		}
+
+		index, err := loadFileIndex(indexFilename(logFile.filename))
+		if err != nil {
+			continue
+		}
+
+		start := index.firstFrom(timeFrom)
+		end := index.firstAfter(timeTo)
+		if end-start > num-len(messages) {
+			end = start + num - len(messages)
+		}
+		if end < start {
+			continue
+		}
+
+		messages = append(messages, ds.readLogMessages(logFile.filename, buffer, index[start:end])...)
+	}
+
+	return messages
 }
-func (ds *FileMessageDatastore) GetBeforeTime(string, string, string, time.Time, int) []*ircmsg.IrcMessage {
-	return []*ircmsg.IrcMessage{}
+
+// logFilename builds the filename of a log file from the configured template
+func (ds *FileMessageDatastore) logFilename(userID string, networkID string, buffer string, day string) (string, error) {
+	filename := ds.templatePath(userID, networkID, buffer)
+	filename = strings.Replace(filename, "{date}", day, -1)
+	return ds.checkLogPath(filename)
 }
-func (ds *FileMessageDatastore) Search(string, string, string, time.Time, time.Time, int) []*ircmsg.IrcMessage {
-	return []*ircmsg.IrcMessage{}
+
+// templatePath fills in everything in the template other than the date
+func (ds *FileMessageDatastore) templatePath(userID string, networkID string, buffer string) string {
+	replacer := strings.NewReplacer(
+		"{user}", sanitisePathPart(userID),
+		"{network}", sanitisePathPart(networkID),
+		"{buffer}", sanitisePathPart(strings.ToLower(buffer)),
+	)
+	return filepath.Join(ds.logPath, replacer.Replace(ds.template))
 }
 
-func createLineFromMessage(event *ircbnc.HookIrcRaw) (string, string) {
-	line := ""
-	destination := ""
+// checkLogPath makes sure the given path hasn't escaped from the log folder
+func (ds *FileMessageDatastore) checkLogPath(filename string) (string, error) {
+	root := filepath.Clean(ds.logPath)
+	filename = filepath.Clean(filename)
+	if !strings.HasPrefix(filename, root+string(filepath.Separator)) {
+		return "", errLogPathEscaped
+	}
+
+	return filename, nil
+}
 
+type logFile struct {
+	day      string
+	filename string
+}
+
+// logFiles returns the log files that exist for the given buffer, oldest first
+func (ds *FileMessageDatastore) logFiles(userID string, networkID string, buffer string) []logFile {
+	logFiles := []logFile{}
+
+	// Swap the date out for a glob and then pull the date back out of the matching filenames
+	pattern := ds.templatePath(userID, networkID, buffer)
+	dateStart := strings.Index(pattern, "{date}")
+	if dateStart == -1 {
+		return logFiles
+	}
+	before := pattern[:dateStart]
+
+	matches, err := filepath.Glob(strings.Replace(globEscape(pattern), "{date}", "*", -1))
+	if err != nil {
+		return logFiles
+	}
+
+	for _, match := range matches {
+		if !strings.HasPrefix(match, before) || len(match) < len(before)+len(fileLogDateFormat) {
+			continue
+		}
+
+		day := match[len(before) : len(before)+len(fileLogDateFormat)]
+		_, err := time.Parse(fileLogDateFormat, day)
+		if err != nil {
+			continue
+		}
+
+		// The date may be in the template more than once, so only accept files where all of them match
+		expected, err := ds.logFilename(userID, networkID, buffer, day)
+		if err != nil || expected != filepath.Clean(match) {
+			continue
+		}
+
+		logFiles = append(logFiles, logFile{
+			day:      day,
+			filename: match,
+		})
+	}
+
+	sort.Slice(logFiles, func(i, j int) bool {
+		return logFiles[i].day < logFiles[j].day
+	})
+	return logFiles
+}
+
+// readLogMessages reads the indexed lines out of a log file and converts them back into messages
+func (ds *FileMessageDatastore) readLogMessages(filename string, buffer string, records []fileIndexRecord) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	if len(records) == 0 {
+		return messages
+	}
+
+	lines, err := readIndexedLines(filename, records)
+	if err != nil {
+		log.Println("Error reading log file:", err.Error())
+	}
+
+	for idx, line := range lines {
+		message, ok := ds.format.Parse(line, buffer)
+		if !ok {
+			continue
+		}
+
+		message.Tags["time"] = ircmsg.MakeTagValue(records[idx].Time().Format(time.RFC3339))
+		messages = append(messages, &message)
+	}
+
+	return messages
+}
+
+func indexFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".idx"
+}
+
+// sanitisePathPart makes sure a user supplied name can only ever be a single part of a path
+func sanitisePathPart(name string) string {
+	name = strings.Map(func(char rune) rune {
+		if char == '/' || char == '\\' || char == 0 {
+			return '_'
+		}
+		return char
+	}, name)
+
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// globEscape escapes any characters in the path that filepath.Glob would treat specially
+func globEscape(path string) string {
+	replacer := strings.NewReplacer(
+		"\\", "\\\\",
+		"*", "\\*",
+		"?", "\\?",
+		"[", "\\[",
+	)
+	return replacer.Replace(path)
+}
+
+// fileLogMessage returns the buffer the event should be logged to along with the message
+// that should be logged. An empty buffer means the event isn't logged.
+func fileLogMessage(event *ircbnc.HookIrcRaw) (string, ircmsg.IrcMessage) {
 	message := event.Message
+	params := message.Params
 
 	if event.FromServer {
 		switch message.Command {
-		case "PRIVMSG":
-			line = fmt.Sprintf("<%s> %s", message.Prefix, message.Params[1])
-			destination = message.Params[0]
-		case "NOTICE":
-			// TODO: Whats the norm format for logging notices?
-			line = fmt.Sprintf("<%s> [NOTICE] %s", message.Prefix, message.Params[1])
-			destination = message.Params[0]
-		case "JOIN":
-			line = fmt.Sprintf("* %s has joined %s", message.Prefix, message.Params[0])
-			destination = message.Params[0]
-		case "PART":
-			line = fmt.Sprintf("* %s has left %s", message.Prefix, message.Params[0])
-			destination = message.Params[0]
+		case "PRIVMSG", "NOTICE":
+			if len(params) < 2 || isNonActionCtcp(params[1]) {
+				break
+			}
+
+			// Private messages get logged to the buffer of the person that sent them
+			if strings.ToLower(params[0]) == strings.ToLower(event.Server.Foo.Nick) {
+				prefixNick, _, _ := ircbnc.SplitMask(message.Prefix)
+				return prefixNick, message
+			}
+			return params[0], message
+		case "JOIN", "PART":
+			if len(params) < 1 {
+				break
+			}
+			return params[0], message
 		case "QUIT":
-			// line = fmt.Sprintf("* %s has quit", message.Prefix)
-			// destination = ?
-			// TODO: ^ needs to log into all its channels
+			// TODO: needs to log into all its channels
 		case "KICK":
-			line = fmt.Sprintf(
-				"* %s has been kicked from %s by %s (%s)",
-				message.Params[1],
-				message.Params[0],
-				message.Prefix,
-				message.Params[2],
-			)
-			destination = message.Params[0]
-		}
-	} else if event.FromClient && event.Listener.ServerConnection != nil {
+			if len(params) < 2 {
+				break
+			}
+			return params[0], message
+		}
+	} else if event.FromClient && event.Server != nil {
 		switch message.Command {
-		case "PRIVMSG":
-			currentNick := event.Listener.ServerConnection.Nickname
-			line = fmt.Sprintf("<%s> %s", currentNick, message.Params[1])
-			destination = message.Params[0]
-		case "NOTICE":
-			currentNick := event.Listener.ServerConnection.Nickname
-			// TODO: Whats the norm format for logging notices?
-			line = fmt.Sprintf("<%s> %s", currentNick, message.Params[1])
-			destination = message.Params[0]
+		case "PRIVMSG", "NOTICE":
+			if len(params) < 2 || isNonActionCtcp(params[1]) {
+				break
+			}
+
+			currentNick := event.Server.Nickname
+			return params[0], ircmsg.MakeMessage(nil, currentNick, message.Command, params[0], params[1])
 		}
 	}
 
-	if line != "" {
-		line = fmt.Sprintf("[%s] %s", time.Now().Format("2006-01-02 15:04:05"), line)
-	}
-	return line, destination
+	return "", message
+}
+
+func isNonActionCtcp(text string) bool {
+	return strings.HasPrefix(text, "\x01") && !strings.HasPrefix(text, "\x01ACTION")
 }
@@ -0,0 +1,224 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentLogger
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+)
+
+// Prune removes the log lines of the given user's network that fall outside the retention
+func (ds *FileMessageDatastore) Prune(userID string, networkID string, retention ircbnc.MessageRetention) ircbnc.PruneStats {
+	stats := ircbnc.PruneStats{}
+
+	// Logs are only appended to while we're not holding this, so hold it for the whole prune
+	ds.writeLock.Lock()
+	defer ds.writeLock.Unlock()
+
+	for _, logFiles := range ds.bufferLogFiles(userID, networkID) {
+		bufferStats := pruneLogFiles(logFiles, retention)
+		if bufferStats.Messages > 0 {
+			bufferStats.Buffers = 1
+		}
+		stats.Add(bufferStats)
+	}
+
+	return stats
+}
+
+// bufferLogFiles returns the log files for every buffer of the given network, oldest first
+func (ds *FileMessageDatastore) bufferLogFiles(userID string, networkID string) map[string][]logFile {
+	buffers := make(map[string][]logFile)
+
+	// Build a regex that pulls the buffer and date back out of a filename
+	pattern := ds.templatePath(userID, networkID, "{buffer}")
+	notSeparator := "[^" + regexp.QuoteMeta(string(filepath.Separator)) + "]+"
+	placeholders := regexp.MustCompile(`\\\{(buffer|date)\\\}`)
+	quotedPattern := regexp.QuoteMeta(pattern)
+
+	bufferGroup, dateGroup := 0, 0
+	for idx, placeholder := range placeholders.FindAllStringSubmatch(quotedPattern, -1) {
+		if placeholder[1] == "buffer" && bufferGroup == 0 {
+			bufferGroup = idx + 1
+		} else if placeholder[1] == "date" && dateGroup == 0 {
+			dateGroup = idx + 1
+		}
+	}
+	if bufferGroup == 0 || dateGroup == 0 {
+		// Without the buffer in the template there's no way to tell buffers apart
+		return buffers
+	}
+
+	matcher, err := regexp.Compile("^" + placeholders.ReplaceAllString(quotedPattern, "("+notSeparator+")") + "$")
+	if err != nil {
+		return buffers
+	}
+
+	globPattern := strings.NewReplacer("{buffer}", "*", "{date}", "*").Replace(globEscape(pattern))
+	matches, err := filepath.Glob(globPattern)
+	if err != nil {
+		return buffers
+	}
+
+	for _, match := range matches {
+		parts := matcher.FindStringSubmatch(match)
+		if parts == nil {
+			continue
+		}
+
+		buffer, day := parts[bufferGroup], parts[dateGroup]
+		_, err := time.Parse(fileLogDateFormat, day)
+		if err != nil {
+			continue
+		}
+
+		expected, err := ds.logFilename(userID, networkID, buffer, day)
+		if err != nil || expected != filepath.Clean(match) {
+			continue
+		}
+
+		buffers[buffer] = append(buffers[buffer], logFile{
+			day:      day,
+			filename: match,
+		})
+	}
+
+	for _, logFiles := range buffers {
+		sort.Slice(logFiles, func(i, j int) bool {
+			return logFiles[i].day < logFiles[j].day
+		})
+	}
+
+	return buffers
+}
+
+// pruneLogFiles removes the lines from a buffer's log files that fall outside the retention
+func pruneLogFiles(logFiles []logFile, retention ircbnc.MessageRetention) ircbnc.PruneStats {
+	stats := ircbnc.PruneStats{}
+
+	indexes := make([]fileIndex, len(logFiles))
+	sizes := make([]int64, len(logFiles))
+	for idx, logFile := range logFiles {
+		info, err := os.Stat(logFile.filename)
+		if err != nil {
+			continue
+		}
+		sizes[idx] = info.Size()
+
+		indexes[idx], err = loadFileIndex(indexFilename(logFile.filename))
+		if err != nil {
+			indexes[idx] = fileIndex{}
+		}
+	}
+
+	// How many lines from the start of each file need to go
+	drop := make([]int, len(logFiles))
+
+	if retention.MaxAge > 0 {
+		cutoff := time.Now().Add(-retention.MaxAge)
+		for idx, index := range indexes {
+			drop[idx] = index.firstFrom(cutoff)
+		}
+	}
+
+	// Count what we keep from the newest line backwards, dropping everything once a limit is hit
+	keptMessages := 0
+	var keptBytes uint64
+	limitHit := false
+	for i := len(indexes) - 1; i >= 0; i-- {
+		index := indexes[i]
+		if limitHit {
+			drop[i] = len(index)
+			continue
+		}
+
+		for j := len(index) - 1; j >= drop[i]; j-- {
+			lineEnd := sizes[i]
+			if j+1 < len(index) {
+				lineEnd = index[j+1].offset
+			}
+			lineSize := uint64(lineEnd - index[j].offset)
+
+			overMessages := retention.MaxMessages > 0 && keptMessages+1 > retention.MaxMessages
+			overBytes := retention.MaxBytes > 0 && keptBytes+lineSize > retention.MaxBytes
+			if overMessages || overBytes {
+				drop[i] = j + 1
+				limitHit = true
+				break
+			}
+
+			keptMessages++
+			keptBytes += lineSize
+		}
+	}
+
+	for idx, logFile := range logFiles {
+		index := indexes[idx]
+		if drop[idx] == 0 {
+			continue
+		}
+
+		if drop[idx] >= len(index) {
+			err := os.Remove(logFile.filename)
+			if err != nil {
+				log.Println("Error removing log file:", err.Error())
+				continue
+			}
+			os.Remove(indexFilename(logFile.filename))
+			// Tidy up the folder if it's now empty, this fails harmlessly if it isn't
+			os.Remove(filepath.Dir(logFile.filename))
+
+			stats.Messages += len(index)
+			stats.Bytes += uint64(sizes[idx])
+			continue
+		}
+
+		removedBytes, err := truncateLogFile(logFile.filename, index, drop[idx])
+		if err != nil {
+			log.Println("Error pruning log file:", err.Error())
+			continue
+		}
+
+		stats.Messages += drop[idx]
+		stats.Bytes += uint64(removedBytes)
+	}
+
+	return stats
+}
+
+// truncateLogFile removes the first lines of a log file along with their index records
+func truncateLogFile(filename string, index fileIndex, lines int) (int64, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	start := index[lines].offset
+	if start > int64(len(data)) {
+		start = int64(len(data))
+	}
+
+	newIndex := make(fileIndex, 0, len(index)-lines)
+	for _, record := range index[lines:] {
+		newIndex = append(newIndex, fileIndexRecord{
+			ts:     record.ts,
+			offset: record.offset - start,
+		})
+	}
+
+	err = replaceFile(filename, data[start:])
+	if err != nil {
+		return 0, err
+	}
+
+	return start, writeFileIndex(indexFilename(filename), newIndex)
+}
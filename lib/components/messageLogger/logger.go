@@ -6,6 +6,7 @@ package bncComponentLogger
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
 	"log"
 	"strconv"
 	"strings"
@@ -19,25 +20,90 @@ const MaxRetrieveSize int = 50
 
 func Run(manager *ircbnc.Manager) {
 	store, _ := getMessageDataStoreInstance(manager.Config)
-	if store == nil {
-		return
+
+	// Users can choose to only keep their messages in memory, whatever the configured store is
+	memory, isMemory := store.(*MemoryMessageDatastore)
+	if !isMemory {
+		memory = NewMemoryMessageDatastore(map[string]string{})
 	}
 
-	manager.Messages = store
 	l := &Logger{
 		Manager: manager,
+		Memory:  memory,
 	}
 	l.RegisterHooks()
+
+	if store == nil {
+		return
+	}
+	manager.Messages = wrapMessageDatastore(manager, store)
+
+	pruneInterval, _ := manager.Config.Bouncer.Retention.PruneInterval()
+	if pruneInterval > 0 {
+		go l.runPruner(pruneInterval)
+	}
+}
+
+// NewMessageDatastore opens the message store set in the config, for use outside of the
+// running bouncer such as when exporting logs. Returns nil if no store is configured.
+func NewMessageDatastore(manager *ircbnc.Manager) ircbnc.MessageDatastore {
+	store, _ := getMessageDataStoreInstance(manager.Config)
+	if store == nil {
+		return nil
+	}
+	return wrapMessageDatastore(manager, store)
+}
+
+// wrapMessageDatastore makes sure nothing is written to disk in plaintext for
+// users that have enabled log encryption
+func wrapMessageDatastore(manager *ircbnc.Manager, store ircbnc.MessageDatastore) ircbnc.MessageDatastore {
+	if _, isMemory := store.(*MemoryMessageDatastore); isMemory {
+		return store
+	}
+	return NewEncryptedMessageDatastore(manager, store)
 }
 
 func getMessageDataStoreInstance(config *ircbnc.Config) (ircbnc.MessageDatastore, string) {
-	loggingConfig := config.Bouncer.Logging
+	backends := []ircbnc.LoggingBackendConfig{}
+	for _, backendConfig := range config.Bouncer.Logging {
+		if backendConfig.Options["type"] != "" {
+			backends = append(backends, backendConfig)
+		}
+	}
+
+	// A single unfiltered backend doesn't need wrapping up
+	if len(backends) == 1 && backends[0].Filter.IsEmpty() {
+		return newMessageDatastore(backends[0].Options)
+	}
+
+	multiStore := NewMultiMessageDatastore()
+	storageTypes := []string{}
+	for _, backendConfig := range backends {
+		store, storageType := newMessageDatastore(backendConfig.Options)
+		if store == nil {
+			continue
+		}
+		multiStore.AddBackend(store, backendConfig.Filter)
+		storageTypes = append(storageTypes, storageType)
+	}
+
+	if len(storageTypes) == 0 {
+		return nil, ""
+	}
+	return multiStore, strings.Join(storageTypes, ",")
+}
+
+func newMessageDatastore(loggingConfig map[string]string) (ircbnc.MessageDatastore, string) {
 	storageType, _ := loggingConfig["type"]
 
 	var store ircbnc.MessageDatastore
 
 	if storageType == "file" {
 		store = NewFileMessageDatastore(loggingConfig)
+	} else if storageType == "memory" {
+		store = NewMemoryMessageDatastore(loggingConfig)
+	} else if storageType == "buntdb" {
+		store = NewBuntdbMessageDatastore(loggingConfig)
 	} else if storageType == "sqlite" {
 		store = NewSqliteMessageDatastore(loggingConfig)
 		if !(store.SupportsStore() || store.SupportsRetrieve() || store.SupportsSearch()) {
@@ -55,19 +121,82 @@ func getMessageDataStoreInstance(config *ircbnc.Config) (ircbnc.MessageDatastore
 
 type Logger struct {
 	Manager *ircbnc.Manager
+	// Memory stores the messages of users that don't want them written to disk
+	Memory *MemoryMessageDatastore
+}
+
+// storeFor returns the message store used for the given buffer, or nil if its messages aren't stored
+func (logger *Logger) storeFor(server *ircbnc.ServerConnection, buffer string) ircbnc.MessageDatastore {
+	switch server.LogMode(buffer) {
+	case ircbnc.LogModeNone:
+		return nil
+	case ircbnc.LogModePlayback:
+		return logger.Memory
+	}
+
+	if server.User.MessageStore == ircbnc.MessageStoreMemory {
+		return logger.Memory
+	}
+	return logger.Manager.Messages
 }
 
 func (logger *Logger) RegisterHooks() {
 	logger.Manager.Bus.Register(ircbnc.HookIrcRawName, logger.onMessage)
 	logger.Manager.Bus.Register(ircbnc.HookStateSentName, logger.onStateSent)
 	logger.Manager.Bus.Register(ircbnc.HookNewListenerName, logger.onNewListener)
+	logger.Manager.Bus.Register(ircbnc.HookListenerCloseName, logger.onListenerClose)
+	logger.Manager.Bus.Register(ircbnc.HookShutdownName, logger.onShutdown)
+	logger.Manager.Bus.Register(ircbnc.HookBufferNoteName, logger.onBufferNote)
+}
+
+// runPruner applies the retention policies on a schedule
+func (logger *Logger) runPruner(interval time.Duration) {
+	for range time.Tick(interval) {
+		stats, err := logger.Manager.PruneMessages()
+		if err != nil {
+			log.Println("Error pruning stored messages:", err.Error())
+			continue
+		}
+		if stats.Messages > 0 {
+			log.Println("Pruned stored messages:", stats.String())
+		}
+	}
 }
 
 func (logger *Logger) onNewListener(hook interface{}) {
 	event := hook.(*ircbnc.HookNewListener)
-	if logger.Manager.Messages.SupportsRetrieve() {
-		event.Listener.ExtraISupports["CHATHISTORY"] = strconv.Itoa(MaxRetrieveSize)
+	// Any user can have their messages kept in memory, so history is always available
+	event.Listener.ExtraISupports["CHATHISTORY"] = strconv.Itoa(MaxRetrieveSize)
+}
+
+// Stores that queue up messages get closed so that they're written out before we exit
+func (logger *Logger) onShutdown(hook interface{}) {
+	closer, canClose := logger.Manager.Messages.(io.Closer)
+	if !canClose {
+		return
 	}
+
+	err := closer.Close()
+	if err != nil {
+		log.Println("Error closing message store:", err.Error())
+	}
+}
+
+// Things the bouncer did in a buffer are stored as notices from *status
+func (logger *Logger) onBufferNote(hook interface{}) {
+	event := hook.(*ircbnc.HookBufferNote)
+
+	store := logger.storeFor(event.Server, event.Buffer)
+	if store == nil || !store.SupportsStore() {
+		return
+	}
+
+	store.Store(&ircbnc.HookIrcRaw{
+		FromServer: true,
+		User:       event.User,
+		Server:     event.Server,
+		Message:    ircmsg.MakeMessage(nil, logger.Manager.StatusSource, "NOTICE", event.Buffer, event.Text),
+	})
 }
 
 func (logger *Logger) onMessage(hook interface{}) {
@@ -78,11 +207,20 @@ func (logger *Logger) onMessage(hook interface{}) {
 		return
 	}
 
-	logger.Manager.Messages.Store(event)
+	// Messages already handled by the bouncer, or sent to its own queries such as passwords
+	// given to *status, are never stored
+	if event.Server != nil && !event.Halt {
+		buffer, _ := fileLogMessage(event)
+		isBouncerQuery := strings.EqualFold(buffer, logger.Manager.StatusNick) || strings.EqualFold(buffer, ircbnc.HighlightsNick)
+		store := logger.storeFor(event.Server, buffer)
+		if buffer != "" && !isBouncerQuery && store != nil && store.SupportsStore() {
+			store.Store(event)
+		}
+	}
 
 	if event.Message.Command == "CHATHISTORY" {
 		event.Halt = true
-		logger.handleChatHistory(event.Listener, &event.Message)
+		logger.handleChatHistory(event.Listener, event.Server, &event.Message)
 	}
 }
 
@@ -95,40 +233,140 @@ func (logger *Logger) onStateSent(hook interface{}) {
 		return
 	}
 
-	store := logger.Manager.Messages
-	if !store.SupportsRetrieve() {
-		return
-	}
-
 	// Only send buffer history if we're connected to a network
 	if event.Server == nil {
 		return
 	}
 
+	now := time.Now()
 	for _, buffer := range event.Server.Buffers {
-		msgs := store.GetBeforeTime(event.Listener.User.ID, event.Server.Name, buffer.Name, time.Now(), 50)
-		for _, message := range msgs {
-			line, err := message.Line()
-			if err != nil {
-				log.Println("Error building message from storage:", err.Error())
-				continue
-			}
-			event.Listener.SendLine(line)
+		// Detached channels are played back once they're reattached and the client asks for them
+		if buffer.Detached {
+			continue
 		}
+		logger.sendPlayback(event.Listener, event.Server, buffer, now)
+		// Everything up to now has been sent, anything newer goes to the client as it arrives
+		buffer.MarkSeen(event.Listener.ClientID, now)
 	}
 }
 
-func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, msg *ircmsg.IrcMessage) {
-	if !listener.IsCapEnabled("batch") || listener.ServerConnection == nil {
+// sendPlayback sends the client whatever it has missed in the buffer since it last saw it
+func (logger *Logger) sendPlayback(listener *ircbnc.Listener, server *ircbnc.ServerConnection, buffer *ircbnc.ServerConnectionBuffer, now time.Time) {
+	store := logger.storeFor(server, buffer.Name)
+	if store == nil || !store.SupportsRetrieve() {
 		return
 	}
 
-	if len(msg.Params) < 3 {
+	limit := listener.GetPlaybackLimit()
+	seen := buffer.SeenBy(listener.ClientID)
+
+	var msgs []*ircmsg.IrcMessage
+	if !seen.IsZero() {
+		msgs = store.GetFromTime(listener.User.ID, server.Name, buffer.Name, seen, limit+1)
+	}
+	// Clients that have never seen the buffer, or have missed too much of it, get the latest messages
+	if seen.IsZero() || len(msgs) > limit {
+		msgs = store.GetBeforeTime(listener.User.ID, server.Name, buffer.Name, now, limit)
+	}
+	if len(msgs) == 0 {
 		return
 	}
 
-	store := logger.Manager.Messages
-	if !store.SupportsRetrieve() {
+	// Without server-time the client can't tell played back messages from new ones, so
+	// they're marked out and timestamped
+	serverTime := listener.IsCapEnabled("server-time")
+	markerTarget := server.ListenerName(listener, buffer.Name)
+	if !buffer.Channel {
+		markerTarget = listener.ClientNick
+	}
+
+	batchId := ""
+	if listener.IsCapEnabled("batch") {
+		batchId = makeBatchId()
+		listener.Send(nil, "", "BATCH", "+"+batchId, "chathistory", server.ListenerName(listener, buffer.Name))
+	}
+	if !serverTime {
+		listener.Send(nil, listener.Manager.StatusSource, "NOTICE", markerTarget, "Playback start")
+	}
+
+	for _, message := range msgs {
+		if batchId != "" {
+			message.Tags["batch"] = ircmsg.MakeTagValue(batchId)
+		}
+		if !serverTime {
+			timestampMessage(listener, message)
+		}
+		server.SendToListener(listener, message)
+	}
+
+	if !serverTime {
+		listener.Send(nil, listener.Manager.StatusSource, "NOTICE", markerTarget, "Playback end")
+	}
+	if batchId != "" {
+		listener.Send(nil, "", "BATCH", "-"+batchId)
+	}
+}
+
+// timestampMessage prefixes the text of a played back message with the time it was sent
+func timestampMessage(listener *ircbnc.Listener, message *ircmsg.IrcMessage) {
+	if message.Command != "PRIVMSG" && message.Command != "NOTICE" || len(message.Params) < 2 {
+		return
+	}
+
+	tag, exists := message.Tags["time"]
+	if !exists || !tag.HasValue {
+		return
+	}
+	ts, err := time.Parse(time.RFC3339Nano, tag.Value)
+	if err != nil {
+		return
+	}
+
+	timestamp := listener.GetPlaybackTimestamp(ts)
+	if timestamp == "" {
+		return
+	}
+
+	text := message.Params[len(message.Params)-1]
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = "\x01ACTION " + timestamp + " " + strings.TrimPrefix(text, "\x01ACTION ")
+	} else {
+		text = timestamp + " " + text
+	}
+	// The params may belong to the message store, so the message gets new ones
+	params := append([]string(nil), message.Params...)
+	params[len(params)-1] = text
+	message.Params = params
+}
+
+// Remember how far the client got so that its next playback starts from there
+func (logger *Logger) onListenerClose(hook interface{}) {
+	event := hook.(*ircbnc.HookListenerClose)
+	listener := event.Listener
+
+	if !listener.Registered || listener.IsCapEnabled("bouncer") {
+		return
+	}
+
+	now := time.Now()
+	for _, server := range listener.Servers() {
+		for _, buffer := range server.Buffers {
+			buffer.MarkSeen(listener.ClientID, now)
+		}
+
+		err := server.Save()
+		if err != nil {
+			log.Println("Error saving the buffers' seen times:", err.Error())
+		}
+	}
+}
+
+func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, server *ircbnc.ServerConnection, msg *ircmsg.IrcMessage) {
+	if !listener.IsCapEnabled("batch") {
+		return
+	}
+
+	if len(msg.Params) < 3 {
 		return
 	}
 
@@ -168,17 +406,28 @@ func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, msg *ircmsg.I
 		numMessages = -MaxRetrieveSize
 	}
 
-	for _, buffer := range listener.ServerConnection.Buffers {
+	if strings.EqualFold(target, ircbnc.HighlightsNick) {
+		sendMentionHistory(listener, timeFrom, numMessages)
+		return
+	}
+	if server == nil {
+		return
+	}
+
+	for _, buffer := range server.Buffers {
 		// If target == * then send all available buffers
 		if target != "*" && strings.ToLower(target) != strings.ToLower(buffer.Name) {
 			continue
 		}
 
 		var msgs []*ircmsg.IrcMessage
-		if numMessages < 0 {
+		store := logger.storeFor(server, buffer.Name)
+		if store == nil || !store.SupportsRetrieve() {
+			msgs = []*ircmsg.IrcMessage{}
+		} else if numMessages < 0 {
 			msgs = store.GetBeforeTime(
 				listener.User.ID,
-				listener.ServerConnection.Name,
+				server.Name,
 				buffer.Name,
 				timeFrom,
 				numMessages*-1,
@@ -186,7 +435,7 @@ func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, msg *ircmsg.I
 		} else {
 			msgs = store.GetFromTime(
 				listener.User.ID,
-				listener.ServerConnection.Name,
+				server.Name,
 				buffer.Name,
 				timeFrom,
 				numMessages,
@@ -194,10 +443,14 @@ func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, msg *ircmsg.I
 		}
 
 		batchId := makeBatchId()
-		listener.Send(nil, "", "BATCH", "+"+batchId, "chathistory", buffer.Name)
+		listener.Send(nil, "", "BATCH", "+"+batchId, "chathistory", server.ListenerName(listener, buffer.Name))
 
 		for _, message := range msgs {
 			message.Tags["batch"] = ircmsg.MakeTagValue(batchId)
+			message = server.MessageForListener(listener, message)
+			if message == nil {
+				continue
+			}
 			line, err := message.Line()
 			if err != nil {
 				log.Println("Error building message from storage:", err.Error())
@@ -210,6 +463,49 @@ func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, msg *ircmsg.I
 	}
 }
 
+// sendMentionHistory sends the messages that highlighted the user as the history of the *highlights buffer
+func sendMentionHistory(listener *ircbnc.Listener, timeFrom time.Time, numMessages int) {
+	msgs := []ircmsg.IrcMessage{}
+	mentions := listener.User.GetMentions()
+	if numMessages < 0 {
+		for i := len(mentions) - 1; i >= 0 && len(msgs) < -numMessages; i-- {
+			if mentions[i].Time.Before(timeFrom) {
+				msgs = append([]ircmsg.IrcMessage{mentions[i].Message(ircbnc.HighlightsNick)}, msgs...)
+			}
+		}
+	} else {
+		for _, mention := range mentions {
+			if len(msgs) >= numMessages {
+				break
+			}
+			if mention.Time.After(timeFrom) {
+				msgs = append(msgs, mention.Message(ircbnc.HighlightsNick))
+			}
+		}
+	}
+
+	batchId := makeBatchId()
+	listener.Send(nil, "", "BATCH", "+"+batchId, "chathistory", ircbnc.HighlightsNick)
+	for _, message := range msgs {
+		message.Tags["batch"] = ircmsg.MakeTagValue(batchId)
+		listener.SendMessage(&message)
+	}
+	listener.Send(nil, "", "BATCH", "-"+batchId)
+}
+
+// eventTime returns when the event's message was sent, using its time tag when it has one
+// so that imported messages keep their original times
+func eventTime(event *ircbnc.HookIrcRaw) time.Time {
+	tag, exists := event.Message.Tags["time"]
+	if exists && tag.HasValue {
+		ts, err := time.Parse(time.RFC3339Nano, tag.Value)
+		if err == nil {
+			return ts
+		}
+	}
+	return time.Now()
+}
+
 func makeBatchId() string {
 	length := 8
 	b := make([]byte, length)
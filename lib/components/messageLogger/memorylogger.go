@@ -0,0 +1,188 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentLogger
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const defaultMemoryBufferSize = 500
+
+type memoryMessage struct {
+	ts      time.Time
+	message ircmsg.IrcMessage
+}
+
+// memoryBuffer is a ring buffer holding the latest messages of a single buffer
+type memoryBuffer struct {
+	messages []memoryMessage
+	// next is where the next message goes once the buffer is full
+	next int
+}
+
+func (buffer *memoryBuffer) add(message memoryMessage, size int) {
+	// The size may have changed since the buffer filled up, so straighten it back out first
+	if len(buffer.messages) != size && buffer.next != 0 {
+		buffer.messages = buffer.ordered()
+		buffer.next = 0
+	}
+	if len(buffer.messages) > size {
+		buffer.messages = buffer.messages[len(buffer.messages)-size:]
+	}
+
+	if len(buffer.messages) < size {
+		buffer.messages = append(buffer.messages, message)
+		return
+	}
+
+	buffer.messages[buffer.next] = message
+	buffer.next = (buffer.next + 1) % size
+}
+
+// ordered returns the messages in the buffer oldest first
+func (buffer *memoryBuffer) ordered() []memoryMessage {
+	ordered := make([]memoryMessage, 0, len(buffer.messages))
+	ordered = append(ordered, buffer.messages[buffer.next:]...)
+	ordered = append(ordered, buffer.messages[:buffer.next]...)
+	return ordered
+}
+
+// MemoryMessageDatastore keeps the latest messages of every buffer in memory so
+// that playback works without anything being written to disk. Everything is lost
+// when the bouncer restarts.
+type MemoryMessageDatastore struct {
+	size    int
+	buffers map[string]*memoryBuffer
+	lock    sync.RWMutex
+}
+
+func NewMemoryMessageDatastore(config map[string]string) *MemoryMessageDatastore {
+	ds := &MemoryMessageDatastore{
+		size:    defaultMemoryBufferSize,
+		buffers: make(map[string]*memoryBuffer),
+	}
+
+	if config["size"] != "" {
+		size, err := strconv.Atoi(config["size"])
+		if err != nil || size <= 0 {
+			log.Println("Invalid memory logger size, using the default instead")
+		} else {
+			ds.size = size
+		}
+	}
+
+	return ds
+}
+
+func (ds *MemoryMessageDatastore) SupportsStore() bool {
+	return true
+}
+func (ds *MemoryMessageDatastore) SupportsRetrieve() bool {
+	return true
+}
+func (ds *MemoryMessageDatastore) SupportsSearch() bool {
+	return true
+}
+
+func (ds *MemoryMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
+	buffer, message := fileLogMessage(event)
+	if buffer == "" {
+		return
+	}
+
+	// Users can choose how many messages they keep
+	size := ds.size
+	if event.User.MemoryBufferSize > 0 {
+		size = event.User.MemoryBufferSize
+	}
+
+	// The message's params are shared with everything else handling the event
+	message.Tags = nil
+	message.Params = append([]string(nil), message.Params...)
+	key := memoryBufferKey(event.User.ID, event.Server.Name, buffer)
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	memBuffer, exists := ds.buffers[key]
+	if !exists {
+		memBuffer = &memoryBuffer{}
+		ds.buffers[key] = memBuffer
+	}
+	memBuffer.add(memoryMessage{
+		ts:      eventTime(event).UTC(),
+		message: message,
+	}, size)
+}
+
+func (ds *MemoryMessageDatastore) GetFromTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	for _, stored := range ds.bufferMessages(userID, networkID, buffer) {
+		if len(messages) >= num {
+			break
+		}
+		if stored.ts.After(timeFrom) {
+			messages = append(messages, memoryToIrcMessage(stored))
+		}
+	}
+	return messages
+}
+func (ds *MemoryMessageDatastore) GetBeforeTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	stored := ds.bufferMessages(userID, networkID, buffer)
+	for i := len(stored) - 1; i >= 0; i-- {
+		if len(messages) >= num {
+			break
+		}
+		if stored[i].ts.Before(timeFrom) {
+			messages = append([]*ircmsg.IrcMessage{memoryToIrcMessage(stored[i])}, messages...)
+		}
+	}
+	return messages
+}
+func (ds *MemoryMessageDatastore) Search(userID string, networkID string, buffer string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage {
+	messages := []*ircmsg.IrcMessage{}
+	for _, stored := range ds.bufferMessages(userID, networkID, buffer) {
+		if len(messages) >= num {
+			break
+		}
+		if !stored.ts.Before(timeFrom) && !stored.ts.After(timeTo) {
+			messages = append(messages, memoryToIrcMessage(stored))
+		}
+	}
+	return messages
+}
+
+// bufferMessages returns a copy of the messages stored for a buffer, oldest first
+func (ds *MemoryMessageDatastore) bufferMessages(userID string, networkID string, buffer string) []memoryMessage {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	memBuffer, exists := ds.buffers[memoryBufferKey(userID, networkID, buffer)]
+	if !exists {
+		return []memoryMessage{}
+	}
+	return memBuffer.ordered()
+}
+
+func memoryBufferKey(userID string, networkID string, buffer string) string {
+	return userID + "\x00" + networkID + "\x00" + strings.ToLower(buffer)
+}
+
+func memoryToIrcMessage(stored memoryMessage) *ircmsg.IrcMessage {
+	tags := make(map[string]ircmsg.TagValue)
+	tags["time"] = ircmsg.MakeTagValue(stored.ts.Format(time.RFC3339))
+
+	// Played back messages get their own params so changing them can't change what's stored
+	params := append([]string(nil), stored.message.Params...)
+	message := ircmsg.MakeMessage(&tags, stored.message.Prefix, stored.message.Command, params...)
+	return &message
+}
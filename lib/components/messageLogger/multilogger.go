@@ -0,0 +1,136 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentLogger
+
+import (
+	"io"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+type multiBackend struct {
+	store  ircbnc.MessageDatastore
+	filter ircbnc.LoggingFilter
+}
+
+// MultiMessageDatastore stores messages in several datastores at once. Every
+// backend stores the messages its filter matches, and reads are served by the
+// first backend that can retrieve them.
+type MultiMessageDatastore struct {
+	backends []multiBackend
+}
+
+func NewMultiMessageDatastore() *MultiMessageDatastore {
+	return &MultiMessageDatastore{}
+}
+
+// AddBackend adds a datastore that stores the messages matched by the filter
+func (ds *MultiMessageDatastore) AddBackend(store ircbnc.MessageDatastore, filter ircbnc.LoggingFilter) {
+	ds.backends = append(ds.backends, multiBackend{
+		store:  store,
+		filter: filter,
+	})
+}
+
+func (ds *MultiMessageDatastore) SupportsStore() bool {
+	for _, backend := range ds.backends {
+		if backend.store.SupportsStore() {
+			return true
+		}
+	}
+	return false
+}
+func (ds *MultiMessageDatastore) SupportsRetrieve() bool {
+	for _, backend := range ds.backends {
+		if backend.store.SupportsRetrieve() {
+			return true
+		}
+	}
+	return false
+}
+func (ds *MultiMessageDatastore) SupportsSearch() bool {
+	for _, backend := range ds.backends {
+		if backend.store.SupportsSearch() {
+			return true
+		}
+	}
+	return false
+}
+
+func (ds *MultiMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
+	buffer, _ := fileLogMessage(event)
+	if buffer == "" {
+		return
+	}
+
+	for _, backend := range ds.backends {
+		if !backend.store.SupportsStore() || !backend.filter.Matches(event.User.ID, event.Server.Name, buffer) {
+			continue
+		}
+		backend.store.Store(event)
+	}
+}
+
+func (ds *MultiMessageDatastore) GetFromTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	store := ds.retriever(userID, networkID, buffer)
+	if store == nil {
+		return []*ircmsg.IrcMessage{}
+	}
+	return store.GetFromTime(userID, networkID, buffer, timeFrom, num)
+}
+func (ds *MultiMessageDatastore) GetBeforeTime(userID string, networkID string, buffer string, timeFrom time.Time, num int) []*ircmsg.IrcMessage {
+	store := ds.retriever(userID, networkID, buffer)
+	if store == nil {
+		return []*ircmsg.IrcMessage{}
+	}
+	return store.GetBeforeTime(userID, networkID, buffer, timeFrom, num)
+}
+func (ds *MultiMessageDatastore) Search(userID string, networkID string, buffer string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage {
+	for _, backend := range ds.backends {
+		if backend.store.SupportsSearch() && backend.filter.Matches(userID, networkID, buffer) {
+			return backend.store.Search(userID, networkID, buffer, timeFrom, timeTo, num)
+		}
+	}
+	return []*ircmsg.IrcMessage{}
+}
+
+// retriever returns the first backend that can retrieve messages for the given buffer
+func (ds *MultiMessageDatastore) retriever(userID string, networkID string, buffer string) ircbnc.MessageDatastore {
+	for _, backend := range ds.backends {
+		if backend.store.SupportsRetrieve() && backend.filter.Matches(userID, networkID, buffer) {
+			return backend.store
+		}
+	}
+	return nil
+}
+
+// Prune prunes every backend that supports it
+func (ds *MultiMessageDatastore) Prune(userID string, networkID string, retention ircbnc.MessageRetention) ircbnc.PruneStats {
+	stats := ircbnc.PruneStats{}
+	for _, backend := range ds.backends {
+		pruner, canPrune := backend.store.(ircbnc.MessagePruner)
+		if canPrune {
+			stats.Add(pruner.Prune(userID, networkID, retention))
+		}
+	}
+	return stats
+}
+
+// Close closes every backend that needs it, returning the first error
+func (ds *MultiMessageDatastore) Close() error {
+	var firstErr error
+	for _, backend := range ds.backends {
+		closer, canClose := backend.store.(io.Closer)
+		if !canClose {
+			continue
+		}
+		err := closer.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -7,14 +7,18 @@ package bncComponentLogger
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/goshuirc/bnc/lib"
 	"github.com/goshuirc/irc-go/ircmsg"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 const TYPE_MESSAGE = 1
@@ -31,10 +35,35 @@ type SqliteMessage struct {
 	line        string
 }
 
+const (
+	defaultSqliteQueueSize     = 1000
+	defaultSqliteBatchSize     = 100
+	defaultSqliteFlushInterval = time.Second
+
+	// sqliteBusyTimeout is how many milliseconds a write waits for another one to finish
+	sqliteBusyTimeout = 5000
+	// sqliteWriteTries is how many times a batch is written while the database stays busy
+	sqliteWriteTries = 3
+
+	// What happens to new messages when the queue is full
+	overflowBlock      = "block"
+	overflowDropNewest = "drop-newest"
+	overflowDropOldest = "drop-oldest"
+)
+
 type SqliteMessageDatastore struct {
-	dbPath       string
-	db           *sql.DB
-	messageQueue chan SqliteMessage
+	dbPath        string
+	db            *sql.DB
+	storeStmt     *sql.Stmt
+	messageQueue  chan SqliteMessage
+	batchSize     int
+	flushInterval time.Duration
+	overflow      string
+	// queueLock stops messages being queued once the queue has been closed
+	queueLock   sync.RWMutex
+	queueClosed bool
+	writerDone  chan struct{}
+	dropped     uint64
 }
 
 func (ds *SqliteMessageDatastore) SupportsStore() bool {
@@ -50,38 +79,153 @@ func NewSqliteMessageDatastore(config map[string]string) *SqliteMessageDatastore
 	ds := &SqliteMessageDatastore{}
 
 	ds.dbPath = config["database"]
-	db, err := sql.Open("sqlite3", ds.dbPath)
+
+	// The batch writer, the pruner and log imports all write to the database. The busy timeout
+	// is set for every pooled connection so they wait for each other, and transactions take the
+	// write lock as they begin so that waiting is all they ever need to do
+	dsn := ds.dbPath
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	dsn += fmt.Sprintf("_busy_timeout=%d&_txlock=immediate", sqliteBusyTimeout)
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	ds.db = db
 
+	// WAL lets playback read from the database while a batch is being written
+	_, err = db.Exec("PRAGMA journal_mode=WAL")
+	if err != nil {
+		log.Println("Error enabling WAL mode on the messages sqlite database:", err.Error())
+	}
+
 	// Create the tables if needed
 	_, err = db.Exec("CREATE TABLE IF NOT EXISTS messages (uid TEXT, netid TEXT, ts INT, buffer TEXT, fromNick TEXT, type INT, line TEXT)")
 	if err != nil {
 		log.Fatal("Error creates messages sqlite database:", err.Error())
 	}
 
+	ds.storeStmt, err = db.Prepare("INSERT INTO messages (uid, netid, ts, buffer, fromNick, type, line) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	queueSize := configInt(config, "queue-size", defaultSqliteQueueSize)
+	ds.batchSize = configInt(config, "batch-size", defaultSqliteBatchSize)
+
+	ds.flushInterval = defaultSqliteFlushInterval
+	if config["flush-interval"] != "" {
+		interval, err := time.ParseDuration(config["flush-interval"])
+		if err != nil || interval <= 0 {
+			log.Println("Invalid sqlite logger flush-interval, using the default instead")
+		} else {
+			ds.flushInterval = interval
+		}
+	}
+
+	ds.overflow = config["overflow"]
+	switch ds.overflow {
+	case overflowBlock, overflowDropNewest, overflowDropOldest:
+	case "":
+		ds.overflow = overflowBlock
+	default:
+		log.Println("Unknown sqlite logger overflow policy " + ds.overflow + ", using block instead")
+		ds.overflow = overflowBlock
+	}
+
 	// Start the queue to insert messages
-	ds.messageQueue = make(chan SqliteMessage)
+	ds.messageQueue = make(chan SqliteMessage, queueSize)
+	ds.writerDone = make(chan struct{})
 	go ds.messageWriter()
 
 	return ds
 }
 
-func (ds *SqliteMessageDatastore) messageWriter() {
-	storeStmt, err := ds.db.Prepare("INSERT INTO messages (uid, netid, ts, buffer, fromNick, type, line) VALUES (?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		log.Fatal(err.Error())
+// configInt reads a positive number from the logging config
+func configInt(config map[string]string, key string, defaultValue int) int {
+	value, exists := config[key]
+	if !exists || value == "" {
+		return defaultValue
+	}
+
+	num, err := strconv.Atoi(value)
+	if err != nil || num <= 0 {
+		log.Println("Invalid logging " + key + " [" + value + "], using the default instead")
+		return defaultValue
 	}
+
+	return num
+}
+
+// messageWriter collects queued messages and writes them in batches, either once
+// enough have been queued or once the flush interval has passed
+func (ds *SqliteMessageDatastore) messageWriter() {
+	defer close(ds.writerDone)
+
+	ticker := time.NewTicker(ds.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SqliteMessage, 0, ds.batchSize)
 	for {
-		message, isOK := <-ds.messageQueue
-		if !isOK {
+		select {
+		case message, isOK := <-ds.messageQueue:
+			if !isOK {
+				ds.writeBatch(batch)
+				return
+			}
+
+			batch = append(batch, message)
+			if len(batch) >= ds.batchSize {
+				ds.writeBatch(batch)
+				batch = batch[:0]
+			}
+
+		case <-ticker.C:
+			ds.writeBatch(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// writeBatch writes the given messages within a single transaction
+func (ds *SqliteMessageDatastore) writeBatch(batch []SqliteMessage) {
+	dropped := atomic.SwapUint64(&ds.dropped, 0)
+	if dropped > 0 {
+		log.Printf("sqlite logger queue is full, dropped %d messages", dropped)
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	// Other writers can keep the database busy for longer than the busy timeout
+	var err error
+	for try := 1; try <= sqliteWriteTries; try++ {
+		err = ds.writeBatchTx(batch)
+		if !isSqliteBusy(err) {
 			break
 		}
+	}
+	if err != nil {
+		log.Printf("Error storing %d messages: %s", len(batch), err.Error())
+	}
+}
+
+// writeBatchTx writes the given messages within a transaction, rolling it back if any can't be written
+func (ds *SqliteMessageDatastore) writeBatchTx(batch []SqliteMessage) error {
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
 
-		storeStmt.Exec(
+	stmt := tx.Stmt(ds.storeStmt)
+	for _, message := range batch {
+		_, err = stmt.Exec(
 			message.user,
 			message.network,
 			message.ts,
@@ -90,7 +234,38 @@ func (ds *SqliteMessageDatastore) messageWriter() {
 			message.messageType,
 			message.line,
 		)
+		if err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
 	}
+	stmt.Close()
+
+	return tx.Commit()
+}
+
+// isSqliteBusy returns true if the error is from another connection holding the database
+func isSqliteBusy(err error) bool {
+	sqliteErr, isSqliteErr := err.(sqlite3.Error)
+	return isSqliteErr && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// Close writes out any queued messages and closes the database
+func (ds *SqliteMessageDatastore) Close() error {
+	ds.queueLock.Lock()
+	if ds.queueClosed {
+		ds.queueLock.Unlock()
+		return nil
+	}
+	ds.queueClosed = true
+	close(ds.messageQueue)
+	ds.queueLock.Unlock()
+
+	<-ds.writerDone
+
+	ds.storeStmt.Close()
+	return ds.db.Close()
 }
 
 func (ds *SqliteMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
@@ -99,14 +274,52 @@ func (ds *SqliteMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
 		return
 	}
 
-	ds.messageQueue <- SqliteMessage{
-		ts:          int32(time.Now().UTC().Unix()),
+	ds.queueMessage(SqliteMessage{
+		ts:          int32(eventTime(event).UTC().Unix()),
 		user:        event.User.ID,
 		network:     event.Server.Name,
 		buffer:      buffer,
 		from:        from,
 		messageType: messageType,
 		line:        line,
+	})
+}
+
+// queueMessage hands a message to the writer, applying the overflow policy if the queue is full
+func (ds *SqliteMessageDatastore) queueMessage(message SqliteMessage) {
+	ds.queueLock.RLock()
+	defer ds.queueLock.RUnlock()
+
+	if ds.queueClosed {
+		return
+	}
+
+	switch ds.overflow {
+	case overflowDropNewest:
+		select {
+		case ds.messageQueue <- message:
+		default:
+			atomic.AddUint64(&ds.dropped, 1)
+		}
+
+	case overflowDropOldest:
+		for {
+			select {
+			case ds.messageQueue <- message:
+				return
+			default:
+			}
+
+			// Make room by throwing away the oldest queued message
+			select {
+			case <-ds.messageQueue:
+				atomic.AddUint64(&ds.dropped, 1)
+			default:
+			}
+		}
+
+	default:
+		ds.messageQueue <- message
 	}
 }
 func (ds *SqliteMessageDatastore) GetFromTime(userID string, networkID string, buffer string, from time.Time, num int) []*ircmsg.IrcMessage {
@@ -157,6 +370,111 @@ func (ds *SqliteMessageDatastore) Search(string, string, string, time.Time, time
 	return []*ircmsg.IrcMessage{}
 }
 
+// Prune removes the messages of the given user's network that fall outside the retention
+func (ds *SqliteMessageDatastore) Prune(userID string, networkID string, retention ircbnc.MessageRetention) ircbnc.PruneStats {
+	stats := ircbnc.PruneStats{}
+
+	buffers := []string{}
+	rows, err := ds.db.Query("SELECT DISTINCT buffer FROM messages WHERE uid = ? AND netid = ?", userID, networkID)
+	if err != nil {
+		log.Println("Prune() error: " + err.Error())
+		return stats
+	}
+	for rows.Next() {
+		var buffer string
+		rows.Scan(&buffer)
+		buffers = append(buffers, buffer)
+	}
+	rows.Close()
+
+	for _, buffer := range buffers {
+		bufferStats := ds.pruneBuffer(userID, networkID, buffer, retention)
+		if bufferStats.Messages > 0 {
+			bufferStats.Buffers = 1
+		}
+		stats.Add(bufferStats)
+	}
+
+	return stats
+}
+
+func (ds *SqliteMessageDatastore) pruneBuffer(userID string, networkID string, buffer string, retention ircbnc.MessageRetention) ircbnc.PruneStats {
+	stats := ircbnc.PruneStats{}
+
+	// Messages older than the cutoff go, a cutoff of 0 keeps them all
+	var cutoff int32
+	if retention.MaxAge > 0 {
+		cutoff = int32(time.Now().Add(-retention.MaxAge).UTC().Unix())
+	}
+
+	// Anything past the newest keep messages goes, -1 keeps them all
+	keep := -1
+	if retention.MaxMessages > 0 {
+		keep = retention.MaxMessages
+	}
+	if retention.MaxBytes > 0 {
+		var err error
+		keep, err = ds.keptWithinBytes(userID, networkID, buffer, retention.MaxBytes, keep)
+		if err != nil {
+			log.Println("Prune() error: " + err.Error())
+			return stats
+		}
+	}
+
+	pruned := "uid = ? AND netid = ? AND buffer = ? AND (ts < ? OR rowid NOT IN (SELECT rowid FROM messages WHERE uid = ? AND netid = ? AND buffer = ? ORDER BY ts DESC, rowid DESC LIMIT ?))"
+	args := []interface{}{userID, networkID, buffer, cutoff, userID, networkID, buffer, keep}
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		log.Println("Prune() error: " + err.Error())
+		return stats
+	}
+
+	var size int64
+	err = tx.QueryRow("SELECT count(*), coalesce(sum(length(line)), 0) FROM messages WHERE "+pruned, args...).Scan(&stats.Messages, &size)
+	if err == nil && stats.Messages > 0 {
+		_, err = tx.Exec("DELETE FROM messages WHERE "+pruned, args...)
+	}
+	if err != nil {
+		log.Println("Prune() error: " + err.Error())
+		tx.Rollback()
+		return ircbnc.PruneStats{}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Prune() error: " + err.Error())
+		return ircbnc.PruneStats{}
+	}
+
+	stats.Bytes = uint64(size)
+	return stats
+}
+
+// keptWithinBytes returns how many of the newest messages in a buffer fit in the given
+// number of bytes, reading no more than the keep messages already being kept
+func (ds *SqliteMessageDatastore) keptWithinBytes(userID string, networkID string, buffer string, maxBytes uint64, keep int) (int, error) {
+	rows, err := ds.db.Query("SELECT length(line) FROM messages WHERE uid = ? AND netid = ? AND buffer = ? ORDER BY ts DESC, rowid DESC LIMIT ?", userID, networkID, buffer, keep)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	kept := 0
+	var keptBytes uint64
+	for rows.Next() {
+		var size uint64
+		rows.Scan(&size)
+		if keptBytes+size > maxBytes {
+			return kept, nil
+		}
+		kept++
+		keptBytes += size
+	}
+
+	return keep, rows.Err()
+}
+
 func rowToIrcMessage(rows *sql.Rows) *ircmsg.IrcMessage {
 	var ts int32
 	var from string
@@ -236,7 +554,7 @@ func extractMessageParts(event *ircbnc.HookIrcRaw) (string, string, int, string)
 				from = prefixNick
 			}
 		}
-	} else if event.FromClient && event.Listener.ServerConnection != nil {
+	} else if event.FromClient && event.Server != nil {
 		switch message.Command {
 		case "PRIVMSG":
 			line = message.Params[1]
@@ -250,7 +568,7 @@ func extractMessageParts(event *ircbnc.HookIrcRaw) (string, string, int, string)
 			}
 
 			buffer = message.Params[0]
-			from = event.Listener.ServerConnection.Nickname
+			from = event.Server.Nickname
 
 		case "NOTICE":
 			line = message.Params[1]
@@ -261,7 +579,7 @@ func extractMessageParts(event *ircbnc.HookIrcRaw) (string, string, int, string)
 			}
 
 			buffer = message.Params[0]
-			from = event.Listener.ServerConnection.Nickname
+			from = event.Server.Nickname
 		}
 	}
 
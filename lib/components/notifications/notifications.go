@@ -0,0 +1,323 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncComponentNotifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+)
+
+const (
+	// NotifyHighlight is sent when a message highlights the user
+	NotifyHighlight = "highlight"
+	// NotifyQuery is sent when someone messages the user privately
+	NotifyQuery = "query"
+	// NotifyTest is sent when the user tests their notification targets
+	NotifyTest = "test"
+
+	sendTimeout = 10 * time.Second
+)
+
+var errWebhookNotAllowed = errors.New("Webhooks can't be posted to private addresses on this bouncer")
+
+// Notification is what gets sent to a user's notification targets
+type Notification struct {
+	Kind    string    `json:"kind"`
+	User    string    `json:"user"`
+	Network string    `json:"network"`
+	Buffer  string    `json:"buffer"`
+	Nick    string    `json:"nick"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+func Run(manager *ircbnc.Manager) {
+	n := &Notifications{
+		Manager: manager,
+		sent:    make(map[string][]time.Time),
+	}
+	n.RegisterHooks()
+}
+
+// Notifications tells users about highlights and private messages that arrive while
+// they're away, through webhooks or local commands
+type Notifications struct {
+	Manager *ircbnc.Manager
+
+	// sent is when each user's recent notifications were sent, for rate limiting
+	sent     map[string][]time.Time
+	sentLock sync.Mutex
+}
+
+func (notifications *Notifications) RegisterHooks() {
+	notifications.Manager.Bus.Register(ircbnc.HookHighlightName, notifications.onHighlight)
+	notifications.Manager.Bus.Register(ircbnc.HookIrcRawName, notifications.onMessage)
+}
+
+func (notifications *Notifications) onHighlight(hook interface{}) {
+	event := hook.(*ircbnc.HookHighlight)
+	mention := event.Mention
+
+	nick, _, _ := ircbnc.SplitMask(mention.Prefix)
+	notifications.notify(event.User, &Notification{
+		Kind:    NotifyHighlight,
+		User:    event.User.ID,
+		Network: mention.Network,
+		Buffer:  mention.Buffer,
+		Nick:    nick,
+		Text:    messageText(mention.Text),
+		Time:    mention.Time,
+	})
+}
+
+func (notifications *Notifications) onMessage(hook interface{}) {
+	event := hook.(*ircbnc.HookIrcRaw)
+	if !event.FromServer || event.User == nil || event.Server == nil {
+		return
+	}
+
+	msg := event.Message
+	if msg.Command != "PRIVMSG" || len(msg.Params) < 2 || !strings.EqualFold(msg.Params[0], event.Server.Foo.Nick) {
+		return
+	}
+
+	// Other CTCPs are answered, not read
+	text := msg.Params[1]
+	if strings.HasPrefix(text, "\x01") && !strings.HasPrefix(text, "\x01ACTION ") {
+		return
+	}
+
+	nick, _, _ := ircbnc.SplitMask(msg.Prefix)
+	if nick == "" || strings.Contains(nick, ".") {
+		// Messages from servers aren't anyone to talk to
+		return
+	}
+
+	// Private messages that highlight the user are sent as highlights instead
+	if event.User.IsHighlight(event.Server, nick, nick, messageText(text)) {
+		return
+	}
+
+	notifications.notify(event.User, &Notification{
+		Kind:    NotifyQuery,
+		User:    event.User.ID,
+		Network: event.Server.Name,
+		Buffer:  nick,
+		Nick:    nick,
+		Text:    messageText(text),
+		Time:    time.Now().UTC(),
+	})
+}
+
+// notify sends a notification to the user's targets if they're away, outside of their
+// quiet hours and haven't gone over their rate limit
+func (notifications *Notifications) notify(user *ircbnc.User, notification *Notification) {
+	settings := user.GetNotifySettings()
+	if len(settings.Targets) == 0 || !user.ShouldNotify() {
+		return
+	}
+
+	if settings.Quiet != nil {
+		location := user.Location()
+		if location == nil {
+			location = time.Local
+		}
+		if settings.Quiet.Contains(time.Now().In(location)) {
+			return
+		}
+	}
+
+	rate := settings.Rate
+	if rate <= 0 {
+		rate = ircbnc.DefaultNotifyRate
+	}
+	if !notifications.allow(user.ID, rate) {
+		return
+	}
+
+	go func() {
+		for _, target := range settings.Targets {
+			err := send(user.Manager.Config, target, notification)
+			if err != nil {
+				log.Printf("Error sending a notification to %s: %s", user.ID, err.Error())
+			}
+		}
+	}()
+}
+
+// allow records a notification for the user, returning false if they've had too many in the last hour
+func (notifications *Notifications) allow(userID string, rate int) bool {
+	notifications.sentLock.Lock()
+	defer notifications.sentLock.Unlock()
+
+	cutoff := time.Now().Add(-time.Hour)
+	recent := []time.Time{}
+	for _, sent := range notifications.sent[userID] {
+		if sent.After(cutoff) {
+			recent = append(recent, sent)
+		}
+	}
+
+	if len(recent) >= rate {
+		notifications.sent[userID] = recent
+		return false
+	}
+
+	notifications.sent[userID] = append(recent, time.Now())
+	return true
+}
+
+// SendTest sends a test notification to each of the user's targets, ignoring their
+// quiet hours and rate limit. Returns the errors from each target that failed.
+func SendTest(user *ircbnc.User) []error {
+	notification := &Notification{
+		Kind: NotifyTest,
+		User: user.ID,
+		Nick: user.Manager.StatusNick,
+		Text: "This is a test notification",
+		Time: time.Now().UTC(),
+	}
+
+	errs := []error{}
+	for _, target := range user.GetNotifySettings().Targets {
+		err := send(user.Manager.Config, target, notification)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", target.Target, err.Error()))
+		}
+	}
+	return errs
+}
+
+func send(config *ircbnc.Config, target *ircbnc.NotifyTarget, notification *Notification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	switch target.Kind {
+	case ircbnc.NotifyWebhook:
+		return sendWebhook(&config.Bouncer.Notifications, target, notification, payload)
+	case ircbnc.NotifyExec:
+		// The bouncer's config may have changed since the target was added
+		if !config.Bouncer.Notifications.AllowExec {
+			return errors.New("Running commands for notifications is disabled on this bouncer")
+		}
+		return runCommand(target, notification, payload)
+	}
+
+	return errors.New("Unknown notification target " + target.Kind)
+}
+
+// webhookClient returns a client that only connects to the addresses webhooks are allowed to be
+// posted to. Addresses are checked as they're dialed, so redirects and DNS changes can't get around it
+func webhookClient(config *ircbnc.NotificationsConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: sendTimeout}
+
+	return &http.Client{
+		Timeout: sendTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(address)
+				if err != nil {
+					return nil, err
+				}
+				addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, addr := range addrs {
+					if config.WebhookAllowed(host, addr.IP) {
+						return dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+					}
+				}
+				return nil, errWebhookNotAllowed
+			},
+			TLSHandshakeTimeout: sendTimeout,
+		},
+	}
+}
+
+func sendWebhook(config *ircbnc.NotificationsConfig, target *ircbnc.NotifyTarget, notification *Notification, payload []byte) error {
+	body := payload
+	contentType := "application/json"
+
+	if target.Template != "" {
+		bodyTemplate, err := template.New("notification").Parse(target.Template)
+		if err != nil {
+			return err
+		}
+		rendered := &bytes.Buffer{}
+		err = bodyTemplate.Execute(rendered, notification)
+		if err != nil {
+			return err
+		}
+
+		body = rendered.Bytes()
+		if !json.Valid(body) {
+			contentType = "text/plain; charset=utf-8"
+		}
+	}
+
+	resp, err := webhookClient(config).Post(target.Target, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// runCommand runs a local command with the notification as JSON on its stdin and in its environment
+func runCommand(target *ircbnc.NotifyTarget, notification *Notification, payload []byte) error {
+	args := strings.Fields(target.Target)
+	if len(args) == 0 {
+		return errors.New("No command to run")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"BNC_KIND="+notification.Kind,
+		"BNC_USER="+notification.User,
+		"BNC_NETWORK="+notification.Network,
+		"BNC_BUFFER="+notification.Buffer,
+		"BNC_NICK="+notification.Nick,
+		"BNC_TEXT="+notification.Text,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// messageText strips the CTCP wrapping from actions
+func messageText(text string) string {
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		return "* " + strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+	}
+	return text
+}
@@ -35,10 +35,14 @@ func (conf *TLSListenConfig) Config() (*tls.Config, error) {
 // Config defines a configuration file for GoshuBNC
 type Config struct {
 	Bouncer struct {
-		Storage      map[string]string
-		Listeners    []string
-		TLSListeners map[string]*TLSListenConfig `yaml:"tls-listeners"`
-		Logging      map[string]string
+		Storage       map[string]string
+		Listeners     []string
+		TLSListeners  map[string]*TLSListenConfig `yaml:"tls-listeners"`
+		Logging       LoggingConfig
+		ExportPath    string `yaml:"export-path"`
+		Retention     RetentionConfig
+		Notifications NotificationsConfig
+		Ctcp          CtcpConfig
 	}
 }
 
@@ -70,5 +74,10 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if len(config.Bouncer.Listeners) == 0 {
 		return nil, errors.New("No listeners are defined")
 	}
+
+	err = config.Bouncer.Retention.validate()
+	if err != nil {
+		return nil, errors.New("Invalid retention config: " + err.Error())
+	}
 	return config, nil
 }
@@ -0,0 +1,60 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"strings"
+)
+
+const (
+	// DefaultCtcpRate is how many CTCPs are answered on each network per minute
+	DefaultCtcpRate = 5
+)
+
+// CtcpConfig holds how CTCPs are answered while none of a user's clients are attached.
+type CtcpConfig struct {
+	// Replies replaces the reply to a CTCP, or stops it being answered when blank
+	Replies map[string]string
+	// Rate is how many CTCPs are answered on each network per minute
+	Rate int
+}
+
+// GetRate returns how many CTCPs are answered on each network per minute.
+func (config *CtcpConfig) GetRate() int {
+	if config.Rate > 0 {
+		return config.Rate
+	}
+	return DefaultCtcpRate
+}
+
+// Reply returns the configured reply to a CTCP and whether one is configured at all.
+func (config *CtcpConfig) Reply(command string) (string, bool) {
+	for name, reply := range config.Replies {
+		if strings.EqualFold(name, command) {
+			return reply, true
+		}
+	}
+	return "", false
+}
+
+// SplitCtcp splits the text of a CTCP into its command and param. Returns false if the
+// text isn't a CTCP.
+func SplitCtcp(text string) (string, string, bool) {
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+
+	text = strings.TrimSuffix(text[1:], "\x01")
+	parts := strings.SplitN(text, " ", 2)
+	command := strings.ToUpper(parts[0])
+	if command == "" {
+		return "", "", false
+	}
+
+	param := ""
+	if len(parts) > 1 {
+		param = parts[1]
+	}
+	return command, param, true
+}
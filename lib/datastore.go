@@ -15,4 +15,6 @@ type DataStoreInterface interface {
 	GetUserNetworks(userId string)
 	SaveConnection(connection *ServerConnection) error
 	DelConnection(connection *ServerConnection) error
+	GetMentions(user *User) []*Mention
+	SaveMentions(user *User, mentions []*Mention) error
 }
@@ -134,9 +134,70 @@ func (ds *DataStore) SaveUser(user *ircbnc.User) error {
 	ui.DefaultNickFallback = user.DefaultFbNick
 	ui.DefaultUsername = user.DefaultUser
 	ui.DefaultRealname = user.DefaultReal
+	ui.Timezone = user.Timezone
+	ui.MessageStore = user.MessageStore
+	ui.MemoryBufferSize = user.MemoryBufferSize
+	ui.LogMode = user.LogMode
+	ui.PlaybackLimit = user.PlaybackLimit
+	ui.PlaybackTimestamp = user.PlaybackTimestamp
+	ui.SaveNick = user.SaveNick
+	ui.HighlightNickOff = user.HighlightNickOff
+	for _, rule := range user.GetHighlightRules() {
+		ui.HighlightRules = append(ui.HighlightRules, HighlightRuleMapping{
+			Kind:    rule.Kind,
+			Pattern: rule.Pattern,
+			Network: rule.Network,
+			Buffer:  rule.Buffer,
+		})
+	}
+	for _, rule := range user.GetIgnoreRules() {
+		ui.IgnoreRules = append(ui.IgnoreRules, IgnoreRuleMapping{
+			Kind:    rule.Kind,
+			Pattern: rule.Pattern,
+			Network: rule.Network,
+			Buffer:  rule.Buffer,
+			Events:  rule.Events,
+		})
+	}
+	notify := user.GetNotifySettings()
+	ui.Notify.IdleAfter = int64(notify.IdleAfter / time.Second)
+	ui.Notify.Rate = notify.Rate
+	if notify.Quiet != nil {
+		ui.Notify.Quiet = notify.Quiet.String()
+	}
+	for _, target := range notify.Targets {
+		ui.Notify.Targets = append(ui.Notify.Targets, NotifyTargetMapping{
+			Kind:     target.Kind,
+			Target:   target.Target,
+			Template: target.Template,
+		})
+	}
+	ui.Clients = make(map[string]*UserClientMapping)
+	for _, client := range user.GetClients() {
+		clientMapping := &UserClientMapping{
+			PlaybackLimit:     client.PlaybackLimit,
+			PlaybackTimestamp: client.PlaybackTimestamp,
+		}
+		for _, connection := range client.History {
+			connectionMapping := &ClientConnectionMapping{
+				Network:   connection.Network,
+				Address:   connection.Address,
+				Connected: connection.Connected.Unix(),
+			}
+			if !connection.Disconnected.IsZero() {
+				connectionMapping.Disconnected = connection.Disconnected.Unix()
+			}
+			clientMapping.History = append(clientMapping.History, connectionMapping)
+		}
+		ui.Clients[client.ID] = clientMapping
+	}
+	ui.LogPublicKey = base64.StdEncoding.EncodeToString(user.LogPublicKey)
+	ui.LogPrivateKey = base64.StdEncoding.EncodeToString(user.LogPrivateKey)
+	ui.LogKeySalt = base64.StdEncoding.EncodeToString(user.LogKeySalt)
 
 	// Just use the username as the ID
-	if user.ID == "" {
+	ui.ID = user.ID
+	if ui.ID == "" {
 		ui.ID = strings.ToLower(user.Name)
 	}
 
@@ -216,6 +277,10 @@ func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
 		NicknameFallback: connection.FbNickname,
 		Username:         connection.Username,
 		Realname:         connection.Realname,
+		RejoinOnKick:     connection.RejoinOnKick,
+		RejoinDelay:      int64(connection.RejoinDelay / time.Second),
+		RejoinTries:      connection.RejoinTries,
+		InviteAllow:      connection.InviteAllow,
 	}
 	scBytes, err := json.Marshal(sc)
 	if err != nil {
@@ -241,12 +306,31 @@ func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
 	// Store server channels (Convert the string map to a slice)
 	scChannels := []*ServerConnectionBufferMapping{}
 	for _, channel := range connection.Buffers {
+		// Buffers that have never been read are stored without a read marker
+		var lastSeen, lastSeenMs int64
+		if !channel.LastSeen.IsZero() {
+			lastSeen = channel.LastSeen.Unix()
+			lastSeenMs = channel.LastSeen.UnixNano() / int64(time.Millisecond)
+		}
+
+		clientsSeen := make(map[string]int64)
+		for clientID, seen := range channel.ClientsSeen() {
+			clientsSeen[clientID] = seen.UnixNano()
+		}
+
 		scChannels = append(scChannels, &ServerConnectionBufferMapping{
-			Name:     channel.Name,
-			Channel:  channel.Channel,
-			Key:      channel.Key,
-			UseKey:   channel.UseKey,
-			LastSeen: channel.LastSeen.Unix(),
+			Name:        channel.Name,
+			Channel:     channel.Channel,
+			Key:         channel.Key,
+			UseKey:      channel.UseKey,
+			LastSeen:    lastSeen,
+			LastSeenMs:  lastSeenMs,
+			ClientsSeen: clientsSeen,
+			LogMode:     channel.LogMode,
+			JoinError:   channel.JoinError,
+			Detached:    channel.Detached,
+			Reattach:    channel.Reattach,
+			Rejoin:      channel.Rejoin,
 		})
 	}
 	scChanBytes, err := json.Marshal(scChannels)
@@ -275,6 +359,66 @@ func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
 	return saveErr
 }
 
+// GetMentions returns the messages that highlighted the user, oldest first
+func (ds *DataStore) GetMentions(user *ircbnc.User) []*ircbnc.Mention {
+	mentions := []*ircbnc.Mention{}
+
+	ds.Db.View(func(tx *buntdb.Tx) error {
+		mentionsString, err := tx.Get(fmt.Sprintf(KeyUserMentions, user.ID))
+		if err != nil {
+			return err
+		}
+
+		mentionMappings := []MentionMapping{}
+		err = json.Unmarshal([]byte(mentionsString), &mentionMappings)
+		if err != nil {
+			log.Println("Could not load the mentions of " + user.ID + ": " + err.Error())
+			return err
+		}
+
+		for _, mapping := range mentionMappings {
+			mentions = append(mentions, &ircbnc.Mention{
+				Time:    time.Unix(0, mapping.Time).UTC(),
+				Network: mapping.Network,
+				Buffer:  mapping.Buffer,
+				Prefix:  mapping.Prefix,
+				Command: mapping.Command,
+				Text:    mapping.Text,
+				Missed:  mapping.Missed,
+			})
+		}
+		return nil
+	})
+
+	return mentions
+}
+
+// SaveMentions replaces the messages that highlighted the user
+func (ds *DataStore) SaveMentions(user *ircbnc.User, mentions []*ircbnc.Mention) error {
+	mentionMappings := []MentionMapping{}
+	for _, mention := range mentions {
+		mentionMappings = append(mentionMappings, MentionMapping{
+			Time:    mention.Time.UnixNano(),
+			Network: mention.Network,
+			Buffer:  mention.Buffer,
+			Prefix:  mention.Prefix,
+			Command: mention.Command,
+			Text:    mention.Text,
+			Missed:  mention.Missed,
+		})
+	}
+
+	mentionsBytes, err := json.Marshal(mentionMappings)
+	if err != nil {
+		return fmt.Errorf("Error marshalling mentions: %s", err.Error())
+	}
+
+	return ds.Db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(KeyUserMentions, user.ID), string(mentionsBytes), nil)
+		return err
+	})
+}
+
 func (ds *DataStore) loadUser(tx *buntdb.Tx, userId string) (*ircbnc.User, error) {
 	user := ircbnc.NewUser(ds.Manager)
 
@@ -299,6 +443,19 @@ func (ds *DataStore) loadUser(tx *buntdb.Tx, userId string) (*ircbnc.User, error
 		return nil, fmt.Errorf("Could not load user (decoding password): %s", err.Error())
 	}
 
+	user.LogPublicKey, err = base64.StdEncoding.DecodeString(ui.LogPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (decoding log public key): %s", err.Error())
+	}
+	user.LogPrivateKey, err = base64.StdEncoding.DecodeString(ui.LogPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (decoding log private key): %s", err.Error())
+	}
+	user.LogKeySalt, err = base64.StdEncoding.DecodeString(ui.LogKeySalt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (decoding log key salt): %s", err.Error())
+	}
+
 	user.ID = ui.ID
 	user.Name = ui.Name
 	user.Role = ui.Role
@@ -306,6 +463,68 @@ func (ds *DataStore) loadUser(tx *buntdb.Tx, userId string) (*ircbnc.User, error
 	user.DefaultFbNick = ui.DefaultNickFallback
 	user.DefaultUser = ui.DefaultUsername
 	user.DefaultReal = ui.DefaultRealname
+	user.Timezone = ui.Timezone
+	user.MessageStore = ui.MessageStore
+	user.MemoryBufferSize = ui.MemoryBufferSize
+	user.LogMode = ui.LogMode
+	user.PlaybackLimit = ui.PlaybackLimit
+	user.PlaybackTimestamp = ui.PlaybackTimestamp
+	user.SaveNick = ui.SaveNick
+	user.HighlightNickOff = ui.HighlightNickOff
+	for _, ruleMapping := range ui.HighlightRules {
+		rule, err := ircbnc.NewHighlightRule(ruleMapping.Kind, ruleMapping.Pattern, ruleMapping.Network, ruleMapping.Buffer)
+		if err != nil {
+			log.Println("Could not load highlight rule of " + ui.ID + ": " + err.Error())
+			continue
+		}
+		user.HighlightRules = append(user.HighlightRules, rule)
+	}
+	for _, ruleMapping := range ui.IgnoreRules {
+		rule, err := ircbnc.NewIgnoreRule(ruleMapping.Kind, ruleMapping.Pattern, ruleMapping.Network, ruleMapping.Buffer, ruleMapping.Events)
+		if err != nil {
+			log.Println("Could not load ignore rule of " + ui.ID + ": " + err.Error())
+			continue
+		}
+		user.IgnoreRules = append(user.IgnoreRules, rule)
+	}
+	user.Notify.IdleAfter = time.Duration(ui.Notify.IdleAfter) * time.Second
+	user.Notify.Rate = ui.Notify.Rate
+	if ui.Notify.Quiet != "" {
+		user.Notify.Quiet, err = ircbnc.ParseQuietHours(ui.Notify.Quiet)
+		if err != nil {
+			log.Println("Could not load the quiet hours of " + ui.ID + ": " + err.Error())
+		}
+	}
+	for _, targetMapping := range ui.Notify.Targets {
+		// Targets are loaded as they were saved, exec targets are checked against the config when they're used
+		user.Notify.Targets = append(user.Notify.Targets, &ircbnc.NotifyTarget{
+			Kind:     targetMapping.Kind,
+			Target:   targetMapping.Target,
+			Template: targetMapping.Template,
+		})
+	}
+	for clientID, clientMapping := range ui.Clients {
+		client := &ircbnc.UserClient{
+			ID:                clientID,
+			PlaybackLimit:     clientMapping.PlaybackLimit,
+			PlaybackTimestamp: clientMapping.PlaybackTimestamp,
+		}
+		for _, connectionMapping := range clientMapping.History {
+			connection := &ircbnc.ClientConnection{
+				Network:   connectionMapping.Network,
+				Address:   connectionMapping.Address,
+				Connected: time.Unix(connectionMapping.Connected, 0).UTC(),
+			}
+			// Connections still open when we last stopped ended some time we don't know about
+			disconnected := connectionMapping.Disconnected
+			if disconnected == 0 {
+				disconnected = connectionMapping.Connected
+			}
+			connection.Disconnected = time.Unix(disconnected, 0).UTC()
+			client.History = append(client.History, connection)
+		}
+		user.Clients[clientID] = client
+	}
 
 	ds.loadUserConnections(user)
 
@@ -356,6 +575,10 @@ func loadServerConnection(name string, user *ircbnc.User, tx *buntdb.Tx) (*ircbn
 	sc.Username = scInfo.Username
 	sc.Realname = scInfo.Realname
 	sc.Password = scInfo.ConnectPassword
+	sc.RejoinOnKick = scInfo.RejoinOnKick
+	sc.RejoinDelay = time.Duration(scInfo.RejoinDelay) * time.Second
+	sc.RejoinTries = scInfo.RejoinTries
+	sc.InviteAllow = scInfo.InviteAllow
 
 	// set default values
 	if sc.Nickname == "" {
@@ -384,13 +607,31 @@ func loadServerConnection(name string, user *ircbnc.User, tx *buntdb.Tx) (*ircbn
 	}
 
 	for _, channel := range *scChans {
-		sc.Buffers.Add(&ircbnc.ServerConnectionBuffer{
-			Channel:  channel.Channel,
-			Name:     channel.Name,
-			Key:      channel.Key,
-			UseKey:   channel.UseKey,
-			LastSeen: time.Unix(channel.LastSeen, 0),
-		})
+		// Read markers used to only be stored to the second, and buffers that have never been
+		// read have none
+		var lastSeen time.Time
+		if channel.LastSeenMs > 0 {
+			lastSeen = time.Unix(0, channel.LastSeenMs*int64(time.Millisecond))
+		} else if channel.LastSeen > 0 {
+			lastSeen = time.Unix(channel.LastSeen, 0)
+		}
+
+		buffer := &ircbnc.ServerConnectionBuffer{
+			Channel:   channel.Channel,
+			Name:      channel.Name,
+			Key:       channel.Key,
+			UseKey:    channel.UseKey,
+			LastSeen:  lastSeen.UTC(),
+			LogMode:   channel.LogMode,
+			JoinError: channel.JoinError,
+			Detached:  channel.Detached,
+			Reattach:  channel.Reattach,
+			Rejoin:    channel.Rejoin,
+		}
+		for clientID, seen := range channel.ClientsSeen {
+			buffer.MarkSeen(clientID, time.Unix(0, seen))
+		}
+		sc.Buffers.Add(buffer)
 	}
 
 	// load addresses
@@ -25,6 +25,8 @@ const (
 	KeyUserInfo = "user.info %s"
 	// KeyUserPermissions stores the permissions that the given user has access to
 	KeyUserPermissions = "user.permissions %s"
+	// KeyUserMentions stores the messages that highlighted the given user
+	KeyUserMentions = "user.mentions %s"
 
 	KeyServerConnectionInfo      = "user.server.info %s %s"
 	KeyServerConnectionAddresses = "user.server.addresses %s %s"
@@ -44,6 +46,84 @@ type UserInfo struct {
 	DefaultNickFallback string `json:"default-nick-fallback"`
 	DefaultUsername     string `json:"default-username"`
 	DefaultRealname     string `json:"default-realname"`
+	Timezone            string `json:"timezone"`
+	MessageStore        string `json:"message-store"`
+	MemoryBufferSize    int    `json:"memory-buffer-size"`
+	LogMode             string `json:"log-mode"`
+	PlaybackLimit       int    `json:"playback-limit"`
+	PlaybackTimestamp   string `json:"playback-timestamp"`
+	LogPublicKey        string `json:"log-public-key"`
+	LogPrivateKey       string `json:"log-private-key"`
+	LogKeySalt          string `json:"log-key-salt"`
+
+	Clients map[string]*UserClientMapping `json:"clients"`
+
+	SaveNick bool `json:"save-nick"`
+
+	HighlightNickOff bool                   `json:"highlight-nick-off"`
+	HighlightRules   []HighlightRuleMapping `json:"highlight-rules"`
+
+	IgnoreRules []IgnoreRuleMapping `json:"ignore-rules"`
+
+	Notify NotifyMapping `json:"notify"`
+}
+
+// NotifyMapping maps NotifySettings to its JSON structure
+type NotifyMapping struct {
+	Targets   []NotifyTargetMapping `json:"targets"`
+	IdleAfter int64                 `json:"idle-after"`
+	Rate      int                   `json:"rate"`
+	Quiet     string                `json:"quiet"`
+}
+
+// NotifyTargetMapping maps NotifyTarget to its JSON structure
+type NotifyTargetMapping struct {
+	Kind     string
+	Target   string
+	Template string
+}
+
+// HighlightRuleMapping maps HighlightRule to its JSON structure
+type HighlightRuleMapping struct {
+	Kind    string
+	Pattern string
+	Network string
+	Buffer  string
+}
+
+// IgnoreRuleMapping maps IgnoreRule to its JSON structure
+type IgnoreRuleMapping struct {
+	Kind    string
+	Pattern string
+	Network string
+	Buffer  string
+	Events  []string
+}
+
+// MentionMapping maps Mention to its JSON structure
+type MentionMapping struct {
+	Time    int64
+	Network string
+	Buffer  string
+	Prefix  string
+	Command string
+	Text    string
+	Missed  bool
+}
+
+// UserClientMapping maps UserClient to its JSON structure
+type UserClientMapping struct {
+	PlaybackLimit     int                        `json:"playback-limit"`
+	PlaybackTimestamp string                     `json:"playback-timestamp"`
+	History           []*ClientConnectionMapping `json:"history"`
+}
+
+// ClientConnectionMapping maps ClientConnection to its JSON structure
+type ClientConnectionMapping struct {
+	Network      string
+	Address      string
+	Connected    int64
+	Disconnected int64
 }
 
 // UserPermissions is a list of permissions the user has access to
@@ -58,6 +138,11 @@ type ServerConnectionMapping struct {
 	NicknameFallback string
 	Username         string
 	Realname         string
+
+	RejoinOnKick bool     `json:"rejoin-on-kick"`
+	RejoinDelay  int64    `json:"rejoin-delay"`
+	RejoinTries  int      `json:"rejoin-tries"`
+	InviteAllow  []string `json:"invite-allow"`
 }
 
 // ServerConnectionAddressMapping maps ServerConnectionAddress to its JSON structure
@@ -70,11 +155,18 @@ type ServerConnectionAddressMapping struct {
 
 // ServerConnectionBufferMapping maps ServerConnectionBuffer to its JSON structure
 type ServerConnectionBufferMapping struct {
-	Channel  bool
-	Name     string
-	Key      string
-	UseKey   bool  `json:"use_key"`
-	LastSeen int64 `json:"last_seen"`
+	Channel     bool
+	Name        string
+	Key         string
+	UseKey      bool             `json:"use_key"`
+	LastSeen    int64            `json:"last_seen"`
+	LastSeenMs  int64            `json:"last_seen_ms"`
+	ClientsSeen map[string]int64 `json:"clients_seen"`
+	LogMode     string           `json:"log_mode"`
+	JoinError   string           `json:"join_error"`
+	Detached    bool             `json:"detached"`
+	Reattach    string           `json:"reattach"`
+	Rejoin      string           `json:"rejoin"`
 }
 
 // InitDB creates the database.
@@ -0,0 +1,147 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"log"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+/**
+ * Detached channels stay joined and logged but aren't sent to clients, so busy
+ * channels that are only wanted for their logs don't clutter every client. They can
+ * be reattached by hand, or automatically when they highlight the user or when
+ * anyone talks in them.
+ */
+
+const (
+	// ReattachNever leaves a detached channel detached until it's attached by hand
+	ReattachNever = ""
+	// ReattachHighlight reattaches a detached channel when it highlights the user
+	ReattachHighlight = "highlight"
+	// ReattachMessage reattaches a detached channel when anyone talks in it
+	ReattachMessage = "message"
+)
+
+// IsValidReattach returns true if the given reattach filter can be used.
+func IsValidReattach(reattach string) bool {
+	return reattach == ReattachNever || reattach == ReattachHighlight || reattach == ReattachMessage
+}
+
+// DetachBuffer detaches a channel, parting it on every attached client while staying in it.
+// Returns false if the channel doesn't exist.
+func (sc *ServerConnection) DetachBuffer(name string, reattach string) bool {
+	buffer := sc.Buffers.Get(name)
+	if buffer == nil || !buffer.Channel {
+		return false
+	}
+
+	wasDetached := buffer.Detached
+	buffer.Detached = true
+	buffer.Reattach = reattach
+	sc.saveDetached(buffer)
+
+	if wasDetached {
+		return true
+	}
+
+	sc.ListenersLock.Lock()
+	for _, listener := range sc.Listeners {
+		if listener.Registered {
+			part := ircmsg.MakeMessage(nil, sc.CurrentMask, "PART", buffer.Name, "Detached")
+			sc.SendToListener(listener, &part)
+		}
+	}
+	sc.ListenersLock.Unlock()
+
+	return true
+}
+
+// AttachBuffer attaches a detached channel, joining it on every attached client.
+// Returns false if the channel doesn't exist.
+func (sc *ServerConnection) AttachBuffer(name string) bool {
+	buffer := sc.Buffers.Get(name)
+	if buffer == nil || !buffer.Channel {
+		return false
+	}
+	if !buffer.Detached {
+		return true
+	}
+
+	buffer.Detached = false
+	buffer.Reattach = ReattachNever
+	sc.saveDetached(buffer)
+
+	sc.ListenersLock.Lock()
+	for _, listener := range sc.Listeners {
+		if listener.Registered {
+			join := ircmsg.MakeMessage(nil, sc.CurrentMask, "JOIN", buffer.Name)
+			sc.SendToListener(listener, &join)
+		}
+	}
+	sc.ListenersLock.Unlock()
+
+	// The names reply goes to all of the clients that were just joined
+	sc.Foo.WriteLine("NAMES %s", buffer.Name)
+	return true
+}
+
+func (sc *ServerConnection) saveDetached(buffer *ServerConnectionBuffer) {
+	err := sc.Save()
+	if err != nil {
+		log.Println("Error saving whether " + buffer.Name + " is detached: " + err.Error())
+	}
+}
+
+// detachedBuffer returns the detached channel the given message is about, if there is one
+func (sc *ServerConnection) detachedBuffer(message *ircmsg.IrcMessage) *ServerConnectionBuffer {
+	idx := -1
+	switch message.Command {
+	case "PRIVMSG", "NOTICE", "TAGMSG", "JOIN", "PART", "KICK", "MODE", "TOPIC":
+		idx = 0
+	case "353":
+		idx = 2
+	default:
+		// Numerics about a channel name it after our nick
+		if indexes, isNumeric := multiNetworkNumerics[message.Command]; isNumeric && indexes[0] == 1 {
+			idx = 1
+		}
+	}
+
+	if idx < 0 || idx >= len(message.Params) {
+		return nil
+	}
+
+	buffer := sc.Buffers.Get(message.Params[idx])
+	if buffer == nil || !buffer.Channel || !buffer.Detached {
+		return nil
+	}
+	return buffer
+}
+
+// shouldReattach returns true if the message passes the detached channel's reattach filter
+func (sc *ServerConnection) shouldReattach(buffer *ServerConnectionBuffer, message *ircmsg.IrcMessage) bool {
+	if buffer.Reattach == ReattachNever || message.Command != "PRIVMSG" && message.Command != "NOTICE" || len(message.Params) < 2 {
+		return false
+	}
+
+	nick, _, _ := SplitMask(message.Prefix)
+	if strings.EqualFold(nick, sc.Foo.Nick) {
+		return false
+	}
+
+	text := message.Params[1]
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		return false
+	}
+
+	if buffer.Reattach == ReattachMessage {
+		return true
+	}
+	return sc.User.IsHighlight(sc, buffer.Name, nick, text)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	// HighlightKeyword highlights messages containing a word
+	HighlightKeyword = "keyword"
+	// HighlightRegex highlights messages matching a regular expression
+	HighlightRegex = "regex"
+	// HighlightExclude stops messages in matching buffers from highlighting
+	HighlightExclude = "exclude"
+)
+
+var errUnknownHighlightKind = errors.New("Highlight rules must be keyword, regex or exclude rules")
+
+// HighlightRule is a rule deciding which messages highlight the user
+type HighlightRule struct {
+	Kind    string
+	Pattern string
+	// Network and Buffer limit the rule to matching buffers, Buffer can be a glob such as #team-*
+	Network string
+	Buffer  string
+
+	regex *regexp.Regexp
+}
+
+// NewHighlightRule creates a highlight rule, making sure it's valid.
+func NewHighlightRule(kind string, pattern string, network string, buffer string) (*HighlightRule, error) {
+	rule := &HighlightRule{
+		Kind:    strings.ToLower(kind),
+		Pattern: pattern,
+		Network: network,
+		Buffer:  buffer,
+	}
+
+	switch rule.Kind {
+	case HighlightKeyword, HighlightExclude:
+	case HighlightRegex:
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rule.regex = regex
+	default:
+		return nil, errUnknownHighlightKind
+	}
+
+	return rule, nil
+}
+
+// AppliesTo returns true if the rule is used for messages in the given buffer.
+func (rule *HighlightRule) AppliesTo(network string, buffer string) bool {
+	if rule.Network != "" && !strings.EqualFold(rule.Network, network) {
+		return false
+	}
+	if rule.Buffer != "" {
+		matched, _ := filepath.Match(strings.ToLower(rule.Buffer), strings.ToLower(buffer))
+		return matched
+	}
+	return true
+}
+
+// Matches returns true if the message text matches the rule. Exclusions match any text.
+func (rule *HighlightRule) Matches(text string) bool {
+	switch rule.Kind {
+	case HighlightKeyword:
+		return containsWord(text, rule.Pattern)
+	case HighlightRegex:
+		return rule.regex != nil && rule.regex.MatchString(text)
+	case HighlightExclude:
+		return true
+	}
+	return false
+}
+
+// String describes the rule for the user
+func (rule *HighlightRule) String() string {
+	description := rule.Kind
+	if rule.Kind != HighlightExclude {
+		description += " " + rule.Pattern
+	}
+
+	scope := rule.Buffer
+	if rule.Network != "" {
+		scope = rule.Network + "/" + scope
+	}
+	if scope != "" {
+		description += " in " + scope
+	}
+	return description
+}
+
+// IsHighlight returns true if a message from the given nick in a buffer highlights the user.
+func (user *User) IsHighlight(server *ServerConnection, buffer string, nick string, text string) bool {
+	// We never highlight ourselves
+	if strings.EqualFold(nick, server.Foo.Nick) {
+		return false
+	}
+
+	rules := user.GetHighlightRules()
+	for _, rule := range rules {
+		if rule.Kind == HighlightExclude && rule.AppliesTo(server.Name, buffer) {
+			return false
+		}
+	}
+
+	if !user.HighlightNickOff && server.Foo.Nick != "" && containsWord(text, server.Foo.Nick) {
+		return true
+	}
+
+	for _, rule := range rules {
+		if rule.Kind != HighlightExclude && rule.AppliesTo(server.Name, buffer) && rule.Matches(text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetHighlightRules returns the user's highlight rules.
+func (user *User) GetHighlightRules() []*HighlightRule {
+	user.highlightLock.Lock()
+	defer user.highlightLock.Unlock()
+
+	rules := make([]*HighlightRule, len(user.HighlightRules))
+	copy(rules, user.HighlightRules)
+	return rules
+}
+
+// AddHighlightRule adds a highlight rule for the user.
+func (user *User) AddHighlightRule(rule *HighlightRule) {
+	user.highlightLock.Lock()
+	defer user.highlightLock.Unlock()
+
+	user.HighlightRules = append(user.HighlightRules, rule)
+}
+
+// DelHighlightRule removes the user's highlight rule at the given index.
+func (user *User) DelHighlightRule(index int) bool {
+	user.highlightLock.Lock()
+	defer user.highlightLock.Unlock()
+
+	if index < 0 || index >= len(user.HighlightRules) {
+		return false
+	}
+	user.HighlightRules = append(user.HighlightRules[:index], user.HighlightRules[index+1:]...)
+	return true
+}
+
+// containsWord returns true if the text contains the word on its own, ignoring case
+func containsWord(text string, word string) bool {
+	if word == "" {
+		return false
+	}
+
+	lowerText := strings.ToLower(text)
+	lowerWord := strings.ToLower(word)
+
+	for start := 0; start <= len(lowerText)-len(lowerWord); {
+		pos := strings.Index(lowerText[start:], lowerWord)
+		if pos == -1 {
+			return false
+		}
+		pos += start
+		end := pos + len(lowerWord)
+
+		if isWordBoundary(lowerText, pos-1) && isWordBoundary(lowerText, end) {
+			return true
+		}
+		start = pos + 1
+	}
+
+	return false
+}
+
+// isWordBoundary returns true if the byte at pos doesn't continue a word
+func isWordBoundary(text string, pos int) bool {
+	if pos < 0 || pos >= len(text) {
+		return true
+	}
+	char := rune(text[pos])
+	if char >= 0x80 {
+		return false
+	}
+	return !unicode.IsLetter(char) && !unicode.IsDigit(char) && !strings.ContainsRune("_-[]\\`^{}|", char)
+}
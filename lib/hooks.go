@@ -71,3 +71,26 @@ type HookStateSent struct {
 	Listener *Listener
 	Server   *ServerConnection
 }
+
+var HookHighlightName = "user.highlight"
+
+type HookHighlight struct {
+	User    *User
+	Server  *ServerConnection
+	Mention *Mention
+}
+
+var HookBufferNoteName = "server.buffernote"
+
+// HookBufferNote is dispatched when the bouncer does something worth recording in a buffer's log
+type HookBufferNote struct {
+	User   *User
+	Server *ServerConnection
+	Buffer string
+	Text   string
+}
+
+var HookShutdownName = "bouncer.shutdown"
+
+type HookShutdown struct {
+}
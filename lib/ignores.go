@@ -0,0 +1,277 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+/**
+ * Ignore rules drop messages from the network before they're relayed to clients or
+ * logged, so that everyone ignored stays ignored on every client. Rules match the
+ * sender's mask or account, or the text of the message, and can be limited to a
+ * network or buffer and to some kinds of events.
+ */
+
+const (
+	// IgnoreMask ignores senders matching a nick!user@host mask such as *!*@spam.example
+	IgnoreMask = "mask"
+	// IgnoreAccount ignores senders logged in to an account
+	IgnoreAccount = "account"
+	// IgnoreRegex ignores messages with text matching a regular expression
+	IgnoreRegex = "regex"
+)
+
+// IgnoreEvents are the kinds of events ignore rules can be limited to
+var IgnoreEvents = []string{"message", "action", "notice", "ctcp", "join", "part", "quit", "nick", "kick", "mode", "topic", "invite"}
+
+// DefaultIgnoreEvents are the events ignored by rules that aren't limited to any
+var DefaultIgnoreEvents = []string{"message", "action", "notice", "ctcp"}
+
+var (
+	errUnknownIgnoreKind  = errors.New("Ignore rules must be mask, account or regex rules")
+	errUnknownIgnoreEvent = errors.New("Ignored events must be " + strings.Join(IgnoreEvents, ", "))
+)
+
+// IgnoreRule is a rule deciding which messages from the network the user never sees
+type IgnoreRule struct {
+	Kind    string
+	Pattern string
+	// Network and Buffer limit the rule to matching buffers, Buffer can be a glob such as #team-*
+	Network string
+	Buffer  string
+	// Events limits the rule to the given kinds of events, DefaultIgnoreEvents when empty
+	Events []string
+
+	regex *regexp.Regexp
+}
+
+// NewIgnoreRule creates an ignore rule, making sure it's valid.
+func NewIgnoreRule(kind string, pattern string, network string, buffer string, events []string) (*IgnoreRule, error) {
+	rule := &IgnoreRule{
+		Kind:    strings.ToLower(kind),
+		Pattern: pattern,
+		Network: network,
+		Buffer:  buffer,
+	}
+
+	for _, event := range events {
+		event = strings.ToLower(event)
+		isKnown := false
+		for _, known := range IgnoreEvents {
+			isKnown = isKnown || event == known
+		}
+		if !isKnown {
+			return nil, errUnknownIgnoreEvent
+		}
+		rule.Events = append(rule.Events, event)
+	}
+
+	switch rule.Kind {
+	case IgnoreAccount:
+	case IgnoreMask:
+		rule.regex = maskRegex(pattern)
+	case IgnoreRegex:
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rule.regex = regex
+	default:
+		return nil, errUnknownIgnoreKind
+	}
+
+	return rule, nil
+}
+
+// maskRegex turns a mask with * and ? wildcards into a case insensitive regular expression
+func maskRegex(mask string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(mask)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	return regexp.MustCompile("(?i)^" + pattern + "$")
+}
+
+// AppliesTo returns true if the rule is used for the given event in the given buffer.
+func (rule *IgnoreRule) AppliesTo(network string, buffer string, event string) bool {
+	if rule.Network != "" && !strings.EqualFold(rule.Network, network) {
+		return false
+	}
+	if rule.Buffer != "" {
+		matched, _ := filepath.Match(strings.ToLower(rule.Buffer), strings.ToLower(buffer))
+		if !matched {
+			return false
+		}
+	}
+	events := rule.Events
+	if len(events) == 0 {
+		events = DefaultIgnoreEvents
+	}
+	for _, ruleEvent := range events {
+		if ruleEvent == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if a message with the given sender, account and text is ignored by the rule.
+func (rule *IgnoreRule) Matches(mask string, account string, text string) bool {
+	switch rule.Kind {
+	case IgnoreMask:
+		return rule.regex != nil && rule.regex.MatchString(mask)
+	case IgnoreAccount:
+		return account != "" && account != "*" && strings.EqualFold(rule.Pattern, account)
+	case IgnoreRegex:
+		return text != "" && rule.regex != nil && rule.regex.MatchString(text)
+	}
+	return false
+}
+
+// String describes the rule for the user
+func (rule *IgnoreRule) String() string {
+	description := rule.Kind + " " + rule.Pattern
+
+	scope := rule.Buffer
+	if rule.Network != "" {
+		scope = rule.Network + "/" + scope
+	}
+	if scope != "" {
+		description += " in " + scope
+	}
+	if len(rule.Events) > 0 {
+		description += " for " + strings.Join(rule.Events, ",")
+	}
+	return description
+}
+
+// ignoreEvent returns the kind of event a message from the network is, the buffer it's
+// in and its text. The event is blank for messages that can't be ignored.
+func ignoreEvent(server *ServerConnection, message *ircmsg.IrcMessage) (string, string, string) {
+	params := message.Params
+	nick, _, _ := SplitMask(message.Prefix)
+
+	buffer := ""
+	if len(params) > 0 {
+		buffer = params[0]
+	}
+	text := ""
+	if len(params) > 1 {
+		text = params[len(params)-1]
+	}
+
+	switch message.Command {
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			return "", "", ""
+		}
+		// Private messages are in the buffer of whoever sent them
+		if strings.EqualFold(buffer, server.Foo.Nick) {
+			buffer = nick
+		}
+
+		event := strings.ToLower(message.Command)
+		if event == "privmsg" {
+			event = "message"
+		}
+		command, param, isCtcp := SplitCtcp(text)
+		if isCtcp && command == "ACTION" {
+			return "action", buffer, param
+		} else if isCtcp {
+			return "ctcp", buffer, param
+		}
+		return event, buffer, text
+	case "JOIN":
+		return "join", buffer, ""
+	case "PART", "KICK", "MODE", "TOPIC":
+		return strings.ToLower(message.Command), buffer, text
+	case "INVITE":
+		if len(params) < 2 {
+			return "", "", ""
+		}
+		return "invite", params[1], ""
+	case "QUIT":
+		// Quits aren't in any one buffer, so only rules for the whole network apply
+		return "quit", "", buffer
+	case "NICK":
+		return "nick", "", ""
+	}
+
+	return "", "", ""
+}
+
+// IsIgnored returns true if the user has ignored the given message from the network.
+func (user *User) IsIgnored(server *ServerConnection, message *ircmsg.IrcMessage) bool {
+	rules := user.GetIgnoreRules()
+	if len(rules) == 0 || message.Prefix == "" {
+		return false
+	}
+
+	// We never ignore ourselves
+	nick, _, _ := SplitMask(message.Prefix)
+	if strings.EqualFold(nick, server.Foo.Nick) {
+		return false
+	}
+
+	event, buffer, text := ignoreEvent(server, message)
+	if event == "" {
+		return false
+	}
+
+	// Kicks and mode changes aimed at us always get through, so clients know what happened to them
+	if event == "kick" || event == "mode" {
+		for _, param := range message.Params {
+			if strings.EqualFold(param, server.Foo.Nick) {
+				return false
+			}
+		}
+	}
+
+	account := ""
+	if tag, exists := message.Tags["account"]; exists && tag.HasValue {
+		account = tag.Value
+	}
+
+	for _, rule := range rules {
+		if rule.AppliesTo(server.Name, buffer, event) && rule.Matches(message.Prefix, account, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetIgnoreRules returns the user's ignore rules.
+func (user *User) GetIgnoreRules() []*IgnoreRule {
+	user.ignoreLock.Lock()
+	defer user.ignoreLock.Unlock()
+
+	rules := make([]*IgnoreRule, len(user.IgnoreRules))
+	copy(rules, user.IgnoreRules)
+	return rules
+}
+
+// AddIgnoreRule adds an ignore rule for the user.
+func (user *User) AddIgnoreRule(rule *IgnoreRule) {
+	user.ignoreLock.Lock()
+	defer user.ignoreLock.Unlock()
+
+	user.IgnoreRules = append(user.IgnoreRules, rule)
+}
+
+// DelIgnoreRule removes the user's ignore rule at the given index.
+func (user *User) DelIgnoreRule(index int) bool {
+	user.ignoreLock.Lock()
+	defer user.ignoreLock.Unlock()
+
+	if index < 0 || index >= len(user.IgnoreRules) {
+		return false
+	}
+	user.IgnoreRules = append(user.IgnoreRules[:index], user.IgnoreRules[index+1:]...)
+	return true
+}
@@ -45,8 +45,9 @@ func loadServerCommands() {
 	ServerCommands[ERR_NICKNAMEINUSE] = ServerCommand{
 		minParams: 0,
 		handler: func(client *Client, msg *ircmsg.IrcMessage) bool {
+			// Once registered, the nick change was asked for by a client that needs to be told
 			if client.HasRegistered {
-				return true
+				return false
 			}
 
 			// TODO: This should use the fallback nick set ont he client
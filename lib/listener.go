@@ -4,6 +4,7 @@
 package ircbnc
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"runtime/debug"
@@ -68,6 +69,17 @@ type Listener struct {
 	regLocks         *RegistrationLocks
 	User             *User
 	ServerConnection *ServerConnection
+	// ClientID identifies which of the user's clients this is, blank for the default client
+	ClientID string
+	// clientConnection records this connection in the client's history
+	clientConnection *ClientConnection
+	// holdsLogKey is set when this listener's login unlocked the user's log key
+	holdsLogKey bool
+
+	// MultiNetwork is set when the listener sees all of its user's networks at once
+	MultiNetwork bool
+	// routedServer is the network named by the message being handled in multi-network mode
+	routedServer *ServerConnection
 }
 
 // NewListener creates a new Listener.
@@ -116,20 +128,32 @@ func (listener *Listener) tryRegistration() {
 	}
 
 	if listener.regLocks.Completed() {
+		if listener.wantsMultiNetwork() {
+			listener.enableMultiNetwork()
+		}
+
 		listener.DumpRegistration()
 		listener.Registered = true
 		listener.DumpChannels()
 
-		listener.Manager.Bus.Dispatch(HookStateSentName, &HookStateSent{
-			Listener: listener,
-			Server:   listener.ServerConnection,
-		})
+		servers := listener.Servers()
+		if len(servers) == 0 {
+			servers = append(servers, nil)
+		}
+		for _, server := range servers {
+			listener.Manager.Bus.Dispatch(HookStateSentName, &HookStateSent{
+				Listener: listener,
+				Server:   server,
+			})
+		}
 	}
 }
 
 // DumpRegistration dumps the registration numerics/replies to the listener.
 func (listener *Listener) DumpRegistration() {
-	if listener.ServerConnection == nil {
+	if listener.MultiNetwork {
+		listener.SendMultiNetworkConnect()
+	} else if listener.ServerConnection == nil {
 		listener.SendNilConnect()
 	} else {
 		listener.ServerConnection.DumpRegistration(listener)
@@ -164,11 +188,67 @@ func (listener *Listener) SendNilConnect() {
 
 // DumpChannels dumps the active channels to the listener.
 func (listener *Listener) DumpChannels() {
-	if listener.ServerConnection != nil {
-		listener.ServerConnection.DumpChannels(listener)
+	for _, server := range listener.Servers() {
+		server.DumpChannels(listener)
 	}
 }
 
+// SwitchNetwork moves the listener from the network it's on to the given one, sending it
+// everything it would have seen had it logged in to that network instead.
+func (listener *Listener) SwitchNetwork(network *ServerConnection) error {
+	if listener.MultiNetwork {
+		return errors.New("You already see all of your networks on this connection")
+	}
+	if !listener.Registered {
+		return errors.New("You have not finished connecting yet")
+	}
+
+	old := listener.ServerConnection
+	if old == network {
+		return errors.New("You are already on " + network.Name)
+	}
+
+	if old != nil {
+		prefix := old.CurrentMask
+		if prefix == "" {
+			prefix = listener.ClientNick
+		}
+
+		now := time.Now()
+		for _, buffer := range old.Buffers {
+			if buffer.Channel {
+				listener.Send(nil, prefix, "PART", buffer.Name, "Switching to "+network.Name)
+			}
+			// Coming back plays back whatever was missed from this point
+			buffer.MarkSeen(listener.ClientID, now)
+		}
+		err := old.Save()
+		if err != nil {
+			log.Println("Error saving the buffers' seen times:", err.Error())
+		}
+
+		old.RemoveListener(listener)
+	}
+
+	network.AddListener(listener)
+	// Connecting here rather than in the background means the registration below waits for it.
+	// Networks the user disconnected from stay disconnected
+	if !network.Foo.Connected && network.Enabled {
+		network.Connect()
+	} else if !network.Foo.Connected {
+		listener.SendStatus("Network " + network.Name + " is disconnected, use connect " + network.Name + " to connect to it")
+	}
+
+	network.DumpRegistration(listener)
+	network.DumpChannels(listener)
+	listener.Manager.Bus.Dispatch(HookStateSentName, &HookStateSent{
+		Listener: listener,
+		Server:   network,
+	})
+
+	return nil
+}
+
 // RunSocketReader reads lines from the listener socket and dispatches them as appropriate.
 func (listener *Listener) RunSocketReader() {
 	for {
@@ -183,8 +263,20 @@ func (listener *Listener) RunSocketReader() {
 	listener.Manager.Bus.Dispatch(HookListenerCloseName, &HookListenerClose{
 		Listener: listener,
 	})
-	if listener.ServerConnection != nil {
-		listener.ServerConnection.RemoveListener(listener)
+	if listener.holdsLogKey {
+		listener.User.ReleaseLogKey()
+		listener.holdsLogKey = false
+	}
+	if listener.clientConnection != nil {
+		listener.User.clientDisconnected(listener.clientConnection)
+		listener.clientConnection = nil
+		err := listener.Manager.Ds.SaveUser(listener.User)
+		if err != nil {
+			log.Println("Error saving the client history of " + listener.User.ID + ": " + err.Error())
+		}
+	}
+	for _, server := range listener.Servers() {
+		server.RemoveListener(listener)
 	}
 }
 
@@ -200,13 +292,24 @@ func (listener *Listener) processIncomingLine(line string) {
 
 	msg, parseLineErr := ircmsg.ParseLine(line)
 
+	// Anything but keeping the connection alive means the user is around
+	if listener.User != nil && listener.Registered && msg.Command != "PING" && msg.Command != "PONG" {
+		listener.User.MarkActive()
+	}
+
+	// Multi-network listeners name the network each message is for
+	listener.routedServer = nil
+	if parseLineErr == nil && listener.MultiNetwork {
+		listener.routedServer = listener.routeMessage(&msg)
+	}
+
 	// Trigger the event if the line parsed or not just incase something else wants to
 	// deal with them
 	hook := &HookIrcRaw{
 		FromClient: true,
 		Listener:   listener,
 		User:       listener.User,
-		Server:     listener.ServerConnection,
+		Server:     listener.Server(),
 		Raw:        line,
 		Message:    msg,
 	}
@@ -234,9 +337,12 @@ func (listener *Listener) processIncomingLine(line string) {
 	}
 
 	// Forward the data
-	if listener.Registered && listener.ServerConnection != nil {
+	server := listener.Server()
+	if listener.Registered && listener.MultiNetwork && server == nil {
+		listener.sendUnrouted(&msg)
+	} else if listener.Registered && server != nil {
 		line, _ := msg.Line()
-		_, err := listener.ServerConnection.Foo.WriteLine(line)
+		_, err := server.Foo.WriteLine(line)
 		if err != nil {
 			log.Println(err.Error())
 		}
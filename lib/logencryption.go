@@ -0,0 +1,270 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+/**
+ * Users can have the bodies of their stored messages encrypted. Each user has
+ * a keypair: messages are encrypted to the public key so that they can be
+ * stored while the user is away, and the private key is stored wrapped with a
+ * key derived from the user's password. The private key is only unwrapped
+ * while the user has an authenticated session, so nothing can be read back off
+ * the disk without the user's password.
+ */
+
+// EncryptedLogPrefix marks stored message text that has been encrypted
+const EncryptedLogPrefix = "+enc:"
+
+const (
+	logKeySaltLen = 32
+	nonceLen      = 24
+	keyLen        = 32
+)
+
+var (
+	errLogEncryptionEnabled    = errors.New("Log encryption is already enabled")
+	errLogEncryptionNotEnabled = errors.New("Log encryption is not enabled")
+	errLogKeyInvalid           = errors.New("Could not unlock the log key")
+)
+
+// LogEncryptionEnabled returns true if this user's stored messages are encrypted.
+func (user *User) LogEncryptionEnabled() bool {
+	return len(user.LogPublicKey) == keyLen
+}
+
+// EnableLogEncryption creates this user's log keypair, wrapping the private key with their password.
+func (user *User) EnableLogEncryption(password string) error {
+	if user.LogEncryptionEnabled() {
+		return errLogEncryptionEnabled
+	}
+
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	salt, wrappedKey, err := wrapLogKey(privateKey, password)
+	if err != nil {
+		return err
+	}
+
+	user.logKeyLock.Lock()
+	defer user.logKeyLock.Unlock()
+
+	user.LogPublicKey = publicKey[:]
+	user.LogKeySalt = salt
+	user.LogPrivateKey = wrappedKey
+
+	return nil
+}
+
+// RewrapLogKey wraps this user's private log key with a new password.
+func (user *User) RewrapLogKey(oldPassword string, newPassword string) error {
+	if !user.LogEncryptionEnabled() {
+		return errLogEncryptionNotEnabled
+	}
+
+	privateKey, err := unwrapLogKey(user.LogKeySalt, user.LogPrivateKey, oldPassword)
+	if err != nil {
+		return err
+	}
+
+	salt, wrappedKey, err := wrapLogKey(privateKey, newPassword)
+	if err != nil {
+		return err
+	}
+
+	user.logKeyLock.Lock()
+	defer user.logKeyLock.Unlock()
+
+	user.LogKeySalt = salt
+	user.LogPrivateKey = wrappedKey
+
+	return nil
+}
+
+// UnlockLogKey unwraps this user's private log key for an authenticated session.
+// Every successful call must be matched with a call to ReleaseLogKey.
+func (user *User) UnlockLogKey(password string) error {
+	if !user.LogEncryptionEnabled() {
+		return errLogEncryptionNotEnabled
+	}
+
+	user.logKeyLock.Lock()
+	defer user.logKeyLock.Unlock()
+
+	if user.logPrivateKey == nil {
+		privateKey, err := unwrapLogKey(user.LogKeySalt, user.LogPrivateKey, password)
+		if err != nil {
+			return err
+		}
+		user.logPrivateKey = privateKey
+	}
+
+	user.logSessions++
+	return nil
+}
+
+// ReleaseLogKey ends a session that unlocked the private log key, forgetting
+// the key once the user has no authenticated sessions left.
+func (user *User) ReleaseLogKey() {
+	user.logKeyLock.Lock()
+	defer user.logKeyLock.Unlock()
+
+	if user.logSessions > 0 {
+		user.logSessions--
+	}
+
+	if user.logSessions == 0 && user.logPrivateKey != nil {
+		for i := range user.logPrivateKey {
+			user.logPrivateKey[i] = 0
+		}
+		user.logPrivateKey = nil
+	}
+}
+
+// EncryptLogText encrypts message text before it's stored. Text is returned
+// untouched if the user hasn't enabled log encryption.
+func (user *User) EncryptLogText(text string) (string, error) {
+	if !user.LogEncryptionEnabled() {
+		return text, nil
+	}
+
+	var publicKey [keyLen]byte
+	copy(publicKey[:], user.LogPublicKey)
+
+	// Each message is sealed with a new ephemeral key so that only the user's private key can open it
+	ephemeralPublic, ephemeralPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce [nonceLen]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return "", err
+	}
+
+	sealed := make([]byte, 0, keyLen+nonceLen+len(text)+box.Overhead)
+	sealed = append(sealed, ephemeralPublic[:]...)
+	sealed = append(sealed, nonce[:]...)
+	sealed = box.Seal(sealed, []byte(text), &nonce, &publicKey, ephemeralPrivate)
+
+	return EncryptedLogPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptLogText decrypts stored message text. Text that isn't encrypted is
+// returned untouched, and false is returned if the text can't be decrypted
+// because the user has no authenticated session.
+func (user *User) DecryptLogText(text string) (string, bool) {
+	if !strings.HasPrefix(text, EncryptedLogPrefix) {
+		return text, true
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(text, EncryptedLogPrefix))
+	if err != nil || len(sealed) < keyLen+nonceLen+box.Overhead {
+		return "", false
+	}
+
+	var ephemeralPublic [keyLen]byte
+	var nonce [nonceLen]byte
+	copy(ephemeralPublic[:], sealed[:keyLen])
+	copy(nonce[:], sealed[keyLen:keyLen+nonceLen])
+
+	user.logKeyLock.Lock()
+	defer user.logKeyLock.Unlock()
+
+	if user.logPrivateKey == nil {
+		return "", false
+	}
+
+	opened, ok := box.Open(nil, sealed[keyLen+nonceLen:], &nonce, &ephemeralPublic, user.logPrivateKey)
+	if !ok {
+		return "", false
+	}
+
+	return string(opened), true
+}
+
+// UnlockLogKey unlocks the log key of this listener's user for as long as the listener is connected.
+func (listener *Listener) UnlockLogKey(password string) error {
+	if listener.holdsLogKey {
+		return nil
+	}
+
+	err := listener.User.UnlockLogKey(password)
+	if err != nil {
+		return err
+	}
+
+	listener.holdsLogKey = true
+	return nil
+}
+
+// passwordKey derives the key used to wrap a private log key from a password
+func passwordKey(salt []byte, password string) (*[keyLen]byte, error) {
+	derived, err := scrypt.Key([]byte(password), salt, 1<<15, 8, 1, keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [keyLen]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+func wrapLogKey(privateKey *[keyLen]byte, password string) ([]byte, []byte, error) {
+	salt := make([]byte, logKeySaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := passwordKey(salt, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nonce [nonceLen]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped := secretbox.Seal(nonce[:], privateKey[:], &nonce, key)
+	return salt, wrapped, nil
+}
+
+func unwrapLogKey(salt []byte, wrapped []byte, password string) (*[keyLen]byte, error) {
+	if len(wrapped) < nonceLen+secretbox.Overhead {
+		return nil, errLogKeyInvalid
+	}
+
+	key, err := passwordKey(salt, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [nonceLen]byte
+	copy(nonce[:], wrapped[:nonceLen])
+
+	opened, ok := secretbox.Open(nil, wrapped[nonceLen:], &nonce, key)
+	if !ok || len(opened) != keyLen {
+		return nil, errLogKeyInvalid
+	}
+
+	var privateKey [keyLen]byte
+	copy(privateKey[:], opened)
+	return &privateKey, nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// LoggingFilter limits which messages a logging backend stores.
+// Empty lists match everything.
+type LoggingFilter struct {
+	Users    []string
+	Networks []string
+	// Buffer names, which may contain * and ? wildcards
+	Buffers []string
+}
+
+// IsEmpty returns true if this filter matches every message.
+func (filter *LoggingFilter) IsEmpty() bool {
+	return len(filter.Users) == 0 && len(filter.Networks) == 0 && len(filter.Buffers) == 0
+}
+
+// Matches returns true if messages in the given buffer should be handled by this filter's backend.
+func (filter *LoggingFilter) Matches(userID string, networkID string, buffer string) bool {
+	if len(filter.Users) > 0 && !filterListContains(filter.Users, userID) {
+		return false
+	}
+	if len(filter.Networks) > 0 && !filterListContains(filter.Networks, networkID) {
+		return false
+	}
+	if len(filter.Buffers) > 0 {
+		matched := false
+		for _, pattern := range filter.Buffers {
+			matched, _ = filepath.Match(strings.ToLower(pattern), strings.ToLower(buffer))
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func filterListContains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.ToLower(item) == strings.ToLower(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoggingBackendConfig is the config of a single message datastore.
+type LoggingBackendConfig struct {
+	// Options holds the datastore specific settings such as type, path and database
+	Options map[string]string
+	Filter  LoggingFilter
+}
+
+// UnmarshalYAML reads the filter out of the backend config and keeps everything else as options.
+func (conf *LoggingBackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var filter struct {
+		Filter LoggingFilter
+	}
+	err := unmarshal(&filter)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]interface{}
+	err = unmarshal(&raw)
+	if err != nil {
+		return err
+	}
+
+	conf.Filter = filter.Filter
+	conf.Options = make(map[string]string)
+	for key, value := range raw {
+		if key == "filter" || value == nil {
+			continue
+		}
+		conf.Options[key] = fmt.Sprint(value)
+	}
+
+	return nil
+}
+
+// LoggingConfig is the list of logging backends that messages are stored in.
+type LoggingConfig []LoggingBackendConfig
+
+// UnmarshalYAML accepts either a list of backends or a single backend.
+func (conf *LoggingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var backends []LoggingBackendConfig
+	err := unmarshal(&backends)
+	if err == nil {
+		*conf = backends
+		return nil
+	}
+
+	var backend LoggingBackendConfig
+	err = unmarshal(&backend)
+	if err != nil {
+		return err
+	}
+
+	*conf = LoggingConfig{backend}
+	return nil
+}
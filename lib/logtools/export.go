@@ -0,0 +1,314 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncLogTools
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// DefaultExportLimit is the most messages exported when no limit is given
+const DefaultExportLimit = 100000
+
+var (
+	errExportCantRetrieve = errors.New("The message store can not retrieve messages")
+	errExportUnknownType  = errors.New("Unknown export format")
+)
+
+// ExportFormats lists the formats messages can be exported to, along with their file extensions
+var ExportFormats = map[string]string{
+	"jsonl": "jsonl",
+	"text":  "txt",
+	"html":  "html",
+}
+
+// ExportOptions describes which messages get exported and how.
+type ExportOptions struct {
+	UserID    string
+	NetworkID string
+	Buffer    string
+	From      time.Time
+	To        time.Time
+	// Limit is the most messages exported, 0 for DefaultExportLimit
+	Limit  int
+	Format string
+	// Location is the timezone times are written in for text and html
+	Location *time.Location
+}
+
+// ExportedMessage is a single message in a jsonl export
+type ExportedMessage struct {
+	Time    string   `json:"time"`
+	Nick    string   `json:"nick"`
+	Prefix  string   `json:"prefix"`
+	Command string   `json:"command"`
+	Params  []string `json:"params"`
+}
+
+// Export writes the messages matching the options from the store to w, returning how many were written.
+func Export(store ircbnc.MessageDatastore, w io.Writer, options ExportOptions) (int, error) {
+	if _, exists := ExportFormats[options.Format]; !exists {
+		return 0, errExportUnknownType
+	}
+
+	messages, err := exportMessages(store, options)
+	if err != nil {
+		return 0, err
+	}
+
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+
+	writer := bufio.NewWriter(w)
+	switch options.Format {
+	case "jsonl":
+		err = exportJSONLines(writer, messages)
+	case "text":
+		err = exportText(writer, messages, options)
+	case "html":
+		err = exportHTML(writer, messages, options)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(messages), writer.Flush()
+}
+
+// ParseExportTime parses a time given on the command line, either as RFC3339 or as a date and optional time
+func ParseExportTime(value string, location *time.Location) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return parsed, nil
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		parsed, err = time.ParseInLocation(layout, value, location)
+		if err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid time [%s], use RFC3339 or YYYY-MM-DD [HH:MM[:SS]]", value)
+}
+
+// exportMessages reads the messages in the time range out of the store
+func exportMessages(store ircbnc.MessageDatastore, options ExportOptions) ([]*ircmsg.IrcMessage, error) {
+	limit := options.Limit
+	if limit <= 0 {
+		limit = DefaultExportLimit
+	}
+	if options.To.IsZero() {
+		options.To = time.Now()
+	}
+
+	if store.SupportsSearch() {
+		return store.Search(options.UserID, options.NetworkID, options.Buffer, options.From, options.To, limit), nil
+	}
+	if !store.SupportsRetrieve() {
+		return nil, errExportCantRetrieve
+	}
+
+	// GetFromTime only returns messages after the given time, so step back to include it
+	messages := []*ircmsg.IrcMessage{}
+	for _, message := range store.GetFromTime(options.UserID, options.NetworkID, options.Buffer, options.From.Add(-time.Nanosecond), limit) {
+		if messageTime(message).After(options.To) {
+			break
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func messageTime(message *ircmsg.IrcMessage) time.Time {
+	tag, exists := message.Tags["time"]
+	if !exists {
+		return time.Time{}
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, tag.Value)
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
+
+func exportJSONLines(w io.Writer, messages []*ircmsg.IrcMessage) error {
+	encoder := json.NewEncoder(w)
+	for _, message := range messages {
+		nick, _, _ := ircbnc.SplitMask(message.Prefix)
+		err := encoder.Encode(ExportedMessage{
+			Time:    messageTime(message).UTC().Format(time.RFC3339Nano),
+			Nick:    nick,
+			Prefix:  message.Prefix,
+			Command: message.Command,
+			Params:  message.Params,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportText(w io.Writer, messages []*ircmsg.IrcMessage, options ExportOptions) error {
+	_, err := fmt.Fprintf(w, "# %s on %s\n", options.Buffer, options.NetworkID)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		ts := messageTime(message).In(options.Location).Format("2006-01-02 15:04:05")
+		_, err = fmt.Fprintf(w, "[%s] %s\n", ts, describeMessage(message))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeMessage returns a readable line for the message, without its time
+func describeMessage(message *ircmsg.IrcMessage) string {
+	nick, _, _ := ircbnc.SplitMask(message.Prefix)
+	line, _ := messageLine(message)
+	switch message.Command {
+	case "PRIVMSG":
+		if isAction(message) {
+			return fmt.Sprintf("* %s %s", nick, line)
+		}
+		return fmt.Sprintf("<%s> %s", nick, line)
+	case "NOTICE":
+		return fmt.Sprintf("-%s- %s", nick, line)
+	}
+	return "*** " + line
+}
+
+func isAction(message *ircmsg.IrcMessage) bool {
+	return message.Command == "PRIVMSG" && len(message.Params) > 1 && strings.HasPrefix(message.Params[1], "\x01ACTION")
+}
+
+// messageLine returns the text of a message along with the css class used for it in html exports
+func messageLine(message *ircmsg.IrcMessage) (string, string) {
+	nick, _, _ := ircbnc.SplitMask(message.Prefix)
+	params := message.Params
+	param := func(idx int) string {
+		if len(params) > idx {
+			return params[idx]
+		}
+		return ""
+	}
+
+	switch message.Command {
+	case "PRIVMSG":
+		if isAction(message) {
+			action := strings.TrimSuffix(strings.TrimPrefix(param(1), "\x01ACTION"), "\x01")
+			return strings.TrimPrefix(action, " "), "action"
+		}
+		return param(1), "message"
+	case "NOTICE":
+		return param(1), "notice"
+	case "JOIN":
+		return fmt.Sprintf("%s has joined %s", message.Prefix, param(0)), "event"
+	case "PART":
+		line := fmt.Sprintf("%s has left %s", message.Prefix, param(0))
+		if param(1) != "" {
+			line += fmt.Sprintf(" (%s)", param(1))
+		}
+		return line, "event"
+	case "KICK":
+		return fmt.Sprintf("%s has been kicked from %s by %s (%s)", param(1), param(0), nick, param(2)), "event"
+	}
+
+	return strings.Join(params, " "), "event"
+}
+
+type htmlExportLine struct {
+	Time  string
+	Nick  string
+	Text  string
+	Class string
+}
+
+type htmlExport struct {
+	Title string
+	From  string
+	To    string
+	Lines []htmlExportLine
+}
+
+var htmlExportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: monospace; background: #fff; color: #222; margin: 2em; }
+h1 { font-size: 1.2em; }
+.range { color: #777; }
+table { border-collapse: collapse; }
+td { padding: 0.1em 0.5em; vertical-align: top; }
+td.time { color: #777; white-space: nowrap; }
+td.nick { font-weight: bold; text-align: right; white-space: nowrap; }
+td.text { white-space: pre-wrap; word-break: break-word; }
+tr.notice td.text { color: #a35a00; }
+tr.action td.text { font-style: italic; }
+tr.event td { color: #2a7a2a; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="range">{{.From}} to {{.To}}</p>
+<table>
+{{range .Lines}}<tr class="{{.Class}}"><td class="time">{{.Time}}</td><td class="nick">{{.Nick}}</td><td class="text">{{.Text}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func exportHTML(w io.Writer, messages []*ircmsg.IrcMessage, options ExportOptions) error {
+	to := options.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	page := htmlExport{
+		Title: fmt.Sprintf("%s on %s", options.Buffer, options.NetworkID),
+		From:  options.From.In(options.Location).Format("2006-01-02 15:04:05"),
+		To:    to.In(options.Location).Format("2006-01-02 15:04:05"),
+		Lines: []htmlExportLine{},
+	}
+
+	for _, message := range messages {
+		nick, _, _ := ircbnc.SplitMask(message.Prefix)
+		text, class := messageLine(message)
+		switch class {
+		case "action":
+			text = nick + " " + text
+			nick = "*"
+		case "notice":
+			nick = "-" + nick + "-"
+		case "event":
+			nick = "***"
+		}
+
+		page.Lines = append(page.Lines, htmlExportLine{
+			Time:  messageTime(message).In(options.Location).Format("2006-01-02 15:04:05"),
+			Nick:  nick,
+			Text:  text,
+			Class: class,
+		})
+	}
+
+	return htmlExportTemplate.Execute(w, page)
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package bncLogTools
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+var errImportCantStore = errors.New("The message store can not store messages")
+
+// ImportedMessage is a message read out of another client's or bouncer's logs
+type ImportedMessage struct {
+	Time    time.Time
+	Message ircmsg.IrcMessage
+}
+
+// ImportParser reads the messages out of a log file. The buffer is used as the target of
+// messages, and times in the log are read in the given location.
+type ImportParser func(r io.Reader, filename string, buffer string, location *time.Location) ([]ImportedMessage, error)
+
+// ImportFormats lists the log formats that can be imported
+var ImportFormats = map[string]ImportParser{
+	"znc":     ParseZNCLog,
+	"irssi":   ParseIrssiLog,
+	"weechat": ParseWeechatLog,
+}
+
+// Import stores the given messages in the user's network buffer. Messages that
+// are already in the store are skipped so that importing the same logs again
+// doesn't duplicate them. Returns how many messages were imported and skipped.
+func Import(store ircbnc.MessageDatastore, user *ircbnc.User, networkID string, buffer string, messages []ImportedMessage) (int, int, error) {
+	if !store.SupportsStore() {
+		return 0, 0, errImportCantStore
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time.Before(messages[j].Time)
+	})
+
+	// Messages are stored as if they came from a connection to the network
+	server := ircbnc.NewServerConnection()
+	server.Name = networkID
+	server.User = user
+
+	imported, skipped := 0, 0
+	existing := make(map[int64]map[string]int)
+	seen := make(map[string]int)
+
+	for _, imp := range messages {
+		second := imp.Time.Unix()
+		if _, checked := existing[second]; !checked {
+			existing[second] = storedMessageKeys(store, user.ID, networkID, buffer, imp.Time.Truncate(time.Second))
+		}
+
+		key := importKey(second, &imp.Message)
+		seen[key]++
+		if seen[key] <= existing[second][key] {
+			skipped++
+			continue
+		}
+
+		message := imp.Message
+		message.Tags = map[string]ircmsg.TagValue{
+			"time": ircmsg.MakeTagValue(imp.Time.UTC().Format(time.RFC3339Nano)),
+		}
+		store.Store(&ircbnc.HookIrcRaw{
+			FromServer: true,
+			User:       user,
+			Server:     server,
+			Message:    message,
+		})
+		imported++
+	}
+
+	return imported, skipped, nil
+}
+
+// storedMessageKeys counts the messages already stored within the given second
+func storedMessageKeys(store ircbnc.MessageDatastore, userID string, networkID string, buffer string, second time.Time) map[string]int {
+	keys := make(map[string]int)
+
+	var messages []*ircmsg.IrcMessage
+	if store.SupportsSearch() {
+		messages = store.Search(userID, networkID, buffer, second, second.Add(time.Second-time.Nanosecond), 1000)
+	} else if store.SupportsRetrieve() {
+		messages = store.GetFromTime(userID, networkID, buffer, second.Add(-time.Nanosecond), 1000)
+	}
+
+	for _, message := range messages {
+		ts := messageTime(message)
+		if ts.Unix() != second.Unix() {
+			continue
+		}
+		keys[importKey(ts.Unix(), message)]++
+	}
+
+	return keys
+}
+
+// importKey identifies a message well enough to tell whether it's already been stored.
+// Only the nick is used as not every store keeps the full prefix.
+func importKey(second int64, message *ircmsg.IrcMessage) string {
+	nick, _, _ := ircbnc.SplitMask(message.Prefix)
+	text := ""
+	if len(message.Params) > 0 {
+		text = message.Params[len(message.Params)-1]
+	}
+	return fmt.Sprintf("%d %s %s %s", second, message.Command, strings.ToLower(nick), text)
+}
+
+// maskFromUserhost builds a nick!user@host prefix
+func maskFromUserhost(nick string, userhost string) string {
+	if userhost == "" {
+		return nick
+	}
+	return nick + "!" + userhost
+}
+
+func makeActionText(action string) string {
+	return "\x01ACTION " + action + "\x01"
+}
+
+/**
+ * ZNC log module
+ * One file per buffer per day, named with the date such as 2017-01-02.log
+ * [15:04:05] <nick> message
+ * [15:04:05] -nick- notice
+ * [15:04:05] * nick action
+ * [15:04:05] *** Joins: nick (ident@host)
+ * [15:04:05] *** Parts: nick (ident@host) (reason)
+ * [15:04:05] *** nick was kicked by op (reason)
+ */
+
+var (
+	zncFilenameDate = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})\.log$`)
+	zncLine         = regexp.MustCompile(`^\[(\d{2}:\d{2}:\d{2})\] (.*)$`)
+	zncLineJoin     = regexp.MustCompile(`^\*\*\* Joins: (\S+) \(([^)]*)\)$`)
+	zncLinePart     = regexp.MustCompile(`^\*\*\* Parts: (\S+) \(([^)]*)\)(?: \((.*)\))?$`)
+	zncLineKick     = regexp.MustCompile(`^\*\*\* (\S+) was kicked by (\S+) \((.*)\)$`)
+	zncLineMessage  = regexp.MustCompile(`^<([^>]+)> (.*)$`)
+	zncLineNotice   = regexp.MustCompile(`^-(\S+?)- (.*)$`)
+	zncLineAction   = regexp.MustCompile(`^\* (\S+) (.*)$`)
+)
+
+// ParseZNCLog parses a log file written by ZNC's log module
+func ParseZNCLog(r io.Reader, filename string, buffer string, location *time.Location) ([]ImportedMessage, error) {
+	dateMatch := zncFilenameDate.FindStringSubmatch(filepath.Base(filename))
+	if dateMatch == nil {
+		return nil, fmt.Errorf("Could not find the date in the filename of %s", filename)
+	}
+	date := dateMatch[1] + "-" + dateMatch[2] + "-" + dateMatch[3]
+
+	messages := []ImportedMessage{}
+	err := scanLines(r, func(line string) {
+		lineMatch := zncLine.FindStringSubmatch(line)
+		if lineMatch == nil {
+			return
+		}
+		ts, err := time.ParseInLocation("2006-01-02 15:04:05", date+" "+lineMatch[1], location)
+		if err != nil {
+			return
+		}
+
+		var message ircmsg.IrcMessage
+		text := lineMatch[2]
+		if m := zncLineJoin.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "JOIN", buffer)
+		} else if m := zncLinePart.FindStringSubmatch(text); m != nil {
+			if m[3] != "" {
+				message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "PART", buffer, m[3])
+			} else {
+				message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "PART", buffer)
+			}
+		} else if m := zncLineKick.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, m[2], "KICK", buffer, m[1], m[3])
+		} else if strings.HasPrefix(text, "*** ") {
+			// Quits, nick changes, modes and topics aren't stored
+			return
+		} else if m := zncLineMessage.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, m[2])
+		} else if m := zncLineNotice.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, m[1], "NOTICE", buffer, m[2])
+		} else if m := zncLineAction.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, makeActionText(m[2]))
+		} else {
+			return
+		}
+
+		messages = append(messages, ImportedMessage{
+			Time:    ts,
+			Message: message,
+		})
+	})
+
+	return messages, err
+}
+
+/**
+ * irssi
+ * --- Log opened Mon Jan 02 15:04:05 2017
+ * --- Day changed Tue Jan 03 2017
+ * 15:04 <@nick> message
+ * 15:04  * nick action
+ * 15:04 -nick(user@host)- notice
+ * 15:04 -!- nick [user@host] has joined #channel
+ * 15:04 -!- nick [user@host] has left #channel [reason]
+ * 15:04 -!- nick was kicked from #channel by op [reason]
+ */
+
+var (
+	irssiLogOpened   = regexp.MustCompile(`^--- Log opened \S+ (\S+ +\d+ \d{2}:\d{2}:\d{2} \d{4})$`)
+	irssiDayChanged  = regexp.MustCompile(`^--- Day changed \S+ (\S+ +\d+ \d{4})$`)
+	irssiLine        = regexp.MustCompile(`^(\d{2}:\d{2}(?::\d{2})?) (.*)$`)
+	irssiLineJoin    = regexp.MustCompile(`^-!- (\S+) \[([^\]]*)\] has joined (\S+)$`)
+	irssiLinePart    = regexp.MustCompile(`^-!- (\S+) \[([^\]]*)\] has left (\S+)(?: \[(.*)\])?$`)
+	irssiLineKick    = regexp.MustCompile(`^-!- (\S+) was kicked from (\S+) by (\S+) \[(.*)\]$`)
+	irssiLineMessage = regexp.MustCompile(`^<[ @+%&~]?([^>]+)> (.*)$`)
+	irssiLineAction  = regexp.MustCompile(`^ \* (\S+) (.*)$`)
+	irssiLineNotice  = regexp.MustCompile(`^-([^(:\s]+)(?:\([^)]*\))?(?::\S+)?- (.*)$`)
+)
+
+// ParseIrssiLog parses a log file written by irssi
+func ParseIrssiLog(r io.Reader, filename string, buffer string, location *time.Location) ([]ImportedMessage, error) {
+	messages := []ImportedMessage{}
+	var day time.Time
+
+	err := scanLines(r, func(line string) {
+		if m := irssiLogOpened.FindStringSubmatch(line); m != nil {
+			opened, err := time.ParseInLocation("Jan _2 15:04:05 2006", m[1], location)
+			if err == nil {
+				day = opened
+			}
+			return
+		}
+		if m := irssiDayChanged.FindStringSubmatch(line); m != nil {
+			changed, err := time.ParseInLocation("Jan _2 2006", m[1], location)
+			if err == nil {
+				day = changed
+			}
+			return
+		}
+
+		lineMatch := irssiLine.FindStringSubmatch(line)
+		if lineMatch == nil || day.IsZero() {
+			return
+		}
+		clock := lineMatch[1]
+		if len(clock) == len("15:04") {
+			clock += ":00"
+		}
+		ts, err := time.ParseInLocation("2006-01-02 15:04:05", day.Format("2006-01-02")+" "+clock, location)
+		if err != nil {
+			return
+		}
+
+		var message ircmsg.IrcMessage
+		text := lineMatch[2]
+		if m := irssiLineJoin.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "JOIN", buffer)
+		} else if m := irssiLinePart.FindStringSubmatch(text); m != nil {
+			if m[4] != "" {
+				message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "PART", buffer, m[4])
+			} else {
+				message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "PART", buffer)
+			}
+		} else if m := irssiLineKick.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, m[3], "KICK", buffer, m[1], m[4])
+		} else if strings.HasPrefix(text, "-!- ") {
+			return
+		} else if m := irssiLineMessage.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, strings.TrimSpace(m[1]), "PRIVMSG", buffer, m[2])
+		} else if m := irssiLineAction.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, makeActionText(m[2]))
+		} else if m := irssiLineNotice.FindStringSubmatch(text); m != nil {
+			message = ircmsg.MakeMessage(nil, m[1], "NOTICE", buffer, m[2])
+		} else {
+			return
+		}
+
+		messages = append(messages, ImportedMessage{
+			Time:    ts,
+			Message: message,
+		})
+	})
+
+	return messages, err
+}
+
+/**
+ * weechat
+ * Tab separated time, prefix and message
+ * 2017-01-02 15:04:05	@nick	message
+ * 2017-01-02 15:04:05	 *	nick action
+ * 2017-01-02 15:04:05	--	Notice(nick) -> #channel: notice
+ * 2017-01-02 15:04:05	-->	nick (user@host) has joined #channel
+ * 2017-01-02 15:04:05	<--	nick (user@host) has left #channel (reason)
+ * 2017-01-02 15:04:05	<--	op has kicked nick (reason)
+ */
+
+var (
+	weechatLineJoin   = regexp.MustCompile(`^(\S+) \(([^)]*)\) has joined (\S+)$`)
+	weechatLinePart   = regexp.MustCompile(`^(\S+) \(([^)]*)\) has left (\S+)(?: \((.*)\))?$`)
+	weechatLineKick   = regexp.MustCompile(`^(\S+) has kicked (\S+)(?: from \S+)?(?: \((.*)\))?$`)
+	weechatLineNotice = regexp.MustCompile(`^Notice\(([^)\s]+)\)(?: -> \S+)?: (.*)$`)
+	weechatLineAction = regexp.MustCompile(`^(\S+) (.*)$`)
+)
+
+// ParseWeechatLog parses a log file written by weechat
+func ParseWeechatLog(r io.Reader, filename string, buffer string, location *time.Location) ([]ImportedMessage, error) {
+	messages := []ImportedMessage{}
+
+	err := scanLines(r, func(line string) {
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 {
+			return
+		}
+		ts, err := time.ParseInLocation("2006-01-02 15:04:05", parts[0], location)
+		if err != nil {
+			return
+		}
+		prefix, text := parts[1], parts[2]
+
+		var message ircmsg.IrcMessage
+		switch prefix {
+		case "-->":
+			m := weechatLineJoin.FindStringSubmatch(text)
+			if m == nil {
+				return
+			}
+			message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "JOIN", buffer)
+		case "<--":
+			if m := weechatLinePart.FindStringSubmatch(text); m != nil {
+				if m[4] != "" {
+					message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "PART", buffer, m[4])
+				} else {
+					message = ircmsg.MakeMessage(nil, maskFromUserhost(m[1], m[2]), "PART", buffer)
+				}
+			} else if m := weechatLineKick.FindStringSubmatch(text); m != nil {
+				message = ircmsg.MakeMessage(nil, m[1], "KICK", buffer, m[2], m[3])
+			} else {
+				return
+			}
+		case "--":
+			m := weechatLineNotice.FindStringSubmatch(text)
+			if m == nil {
+				return
+			}
+			message = ircmsg.MakeMessage(nil, m[1], "NOTICE", buffer, m[2])
+		case " *", "*":
+			m := weechatLineAction.FindStringSubmatch(text)
+			if m == nil {
+				return
+			}
+			message = ircmsg.MakeMessage(nil, m[1], "PRIVMSG", buffer, makeActionText(m[2]))
+		default:
+			nick := strings.TrimLeft(prefix, "@+%&~ ")
+			if nick == "" || strings.ContainsAny(nick, " \t") || strings.Trim(nick, "-=<>!*") == "" {
+				return
+			}
+			message = ircmsg.MakeMessage(nil, nick, "PRIVMSG", buffer, text)
+		}
+
+		messages = append(messages, ImportedMessage{
+			Time:    ts,
+			Message: message,
+		})
+	})
+
+	return messages, err
+}
+
+func scanLines(r io.Reader, handle func(line string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		handle(strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return scanner.Err()
+}
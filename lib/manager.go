@@ -11,6 +11,8 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -32,6 +34,9 @@ type Manager struct {
 	Users     map[string]*User
 	Listeners []net.Listener
 
+	// UsersLock guards Users and each user's Networks while they're changed
+	UsersLock sync.RWMutex
+
 	newConns    chan net.Conn
 	quitSignals chan os.Signal
 
@@ -112,13 +117,16 @@ func (m *Manager) Run() error {
 		m.Listeners = append(m.Listeners, listener)
 	}
 
+	signal.Notify(m.quitSignals, QuitSignals...)
+
 	// and wait
 	var done bool
 	for !done {
 		select {
 		case <-m.quitSignals:
-			//TODO(dan): Write real shutdown code
-			log.Fatal("Shutting down! (TODO: write real shutdown code)")
+			log.Println("Shutting down!")
+			// Give components a chance to write out anything they're holding on to
+			m.Bus.Dispatch(HookShutdownName, &HookShutdown{})
 			done = true
 		case conn := <-m.newConns:
 			go NewListener(m, conn)
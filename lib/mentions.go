@@ -0,0 +1,123 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// HighlightsNick is the virtual query the user's mentions are read from
+	HighlightsNick = "*highlights"
+	// MaxMentions is how many mentions are kept for each user
+	MaxMentions = 500
+)
+
+// Mention is a message that highlighted the user
+type Mention struct {
+	Time    time.Time
+	Network string
+	Buffer  string
+	Prefix  string
+	Command string
+	Text    string
+	// Missed is set while the user hasn't been told about the mention
+	Missed bool
+}
+
+// Message builds an IRC message showing the mention, sent to the given target
+func (mention *Mention) Message(target string) ircmsg.IrcMessage {
+	tags := map[string]ircmsg.TagValue{
+		"time": ircmsg.MakeTagValue(mention.Time.UTC().Format(time.RFC3339)),
+	}
+	return ircmsg.MakeMessage(&tags, mention.Prefix, mention.Command, target, "["+mention.Network+"/"+mention.Buffer+"] "+mention.Text)
+}
+
+// AddMention records a message that highlighted the user, keeping the latest MaxMentions.
+func (user *User) AddMention(mention *Mention) error {
+	text, err := user.EncryptLogText(mention.Text)
+	if err != nil {
+		return err
+	}
+	stored := *mention
+	stored.Text = text
+
+	user.mentionsLock.Lock()
+	defer user.mentionsLock.Unlock()
+
+	mentions := user.Manager.Ds.GetMentions(user)
+	mentions = append(mentions, &stored)
+	if len(mentions) > MaxMentions {
+		mentions = mentions[len(mentions)-MaxMentions:]
+	}
+	return user.Manager.Ds.SaveMentions(user, mentions)
+}
+
+// GetMentions returns the user's mentions, oldest first.
+func (user *User) GetMentions() []*Mention {
+	user.mentionsLock.Lock()
+	mentions := user.Manager.Ds.GetMentions(user)
+	user.mentionsLock.Unlock()
+
+	for _, mention := range mentions {
+		text, decrypted := user.DecryptLogText(mention.Text)
+		if !decrypted {
+			text = "(encrypted)"
+		}
+		mention.Text = text
+	}
+	return mentions
+}
+
+// TakeMissedMentions returns the mentions the user hasn't been told about yet, marking them as seen.
+func (user *User) TakeMissedMentions() ([]*Mention, error) {
+	user.mentionsLock.Lock()
+	defer user.mentionsLock.Unlock()
+
+	mentions := user.Manager.Ds.GetMentions(user)
+	missed := []*Mention{}
+	for _, mention := range mentions {
+		if !mention.Missed {
+			continue
+		}
+		mention.Missed = false
+
+		copied := *mention
+		text, decrypted := user.DecryptLogText(copied.Text)
+		if !decrypted {
+			text = "(encrypted)"
+		}
+		copied.Text = text
+		missed = append(missed, &copied)
+	}
+
+	if len(missed) == 0 {
+		return missed, nil
+	}
+	return missed, user.Manager.Ds.SaveMentions(user, mentions)
+}
+
+// ClearMentions removes all of the user's mentions.
+func (user *User) ClearMentions() error {
+	user.mentionsLock.Lock()
+	defer user.mentionsLock.Unlock()
+
+	return user.Manager.Ds.SaveMentions(user, []*Mention{})
+}
+
+// IsAttached returns true if the user has a client attached to any of their networks.
+func (user *User) IsAttached() bool {
+	for _, network := range user.Networks {
+		network.ListenersLock.Lock()
+		attached := len(network.Listeners) > 0
+		network.ListenersLock.Unlock()
+
+		if attached {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@
 package ircbnc
 
 import (
+	"errors"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircmsg"
@@ -19,3 +20,11 @@ type MessageDatastore interface {
 	SupportsRetrieve() bool
 	SupportsSearch() bool
 }
+
+var errMessagesCantPrune = errors.New("The message store does not support pruning")
+
+// MessagePruner is implemented by message datastores that can remove old messages.
+type MessagePruner interface {
+	// Prune removes the messages of the given user's network that fall outside the retention
+	Prune(userID string, networkID string, retention MessageRetention) PruneStats
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+/**
+ * In multi-network mode a single client connection sees all of the user's networks
+ * at once. Every channel and nick is named along with its network, such as #chan/freenode
+ * and dan/freenode, and whatever the client sends is routed to the network it names.
+ * Clients choose it by requesting the cap or by logging in without naming a network.
+ */
+
+const (
+	// MultiNetworkCap asks for all of the user's networks on the one connection
+	MultiNetworkCap = "goshuirc.net/multi-network"
+	// NetworkSeparator separates a channel or nick from the network it's on
+	NetworkSeparator = "/"
+)
+
+// multiNetworkTargets lists which params of each client command name a channel or nick,
+// and so which network the command is for
+var multiNetworkTargets = map[string][]int{
+	"PRIVMSG":     {0},
+	"NOTICE":      {0},
+	"TAGMSG":      {0},
+	"JOIN":        {0},
+	"PART":        {0},
+	"TOPIC":       {0},
+	"MODE":        {0},
+	"NAMES":       {0},
+	"WHO":         {0},
+	"WHOIS":       {0, 1},
+	"WHOWAS":      {0},
+	"KICK":        {0, 1},
+	"INVITE":      {0, 1},
+	"KNOCK":       {0},
+	"CHATHISTORY": {0},
+	"MARKREAD":    {0},
+}
+
+// multiNetworkNumerics lists which params of each numeric from the server name a channel or nick.
+// The first param is always the client's own nick.
+var multiNetworkNumerics = map[string][]int{
+	"301": {1}, "311": {1}, "312": {1}, "313": {1}, "314": {1}, "315": {1},
+	"317": {1}, "318": {1}, "324": {1}, "329": {1}, "330": {1}, "331": {1},
+	"332": {1}, "333": {1}, "341": {1, 2}, "346": {1}, "347": {1}, "348": {1},
+	"349": {1}, "352": {1, 5}, "366": {1}, "367": {1}, "368": {1}, "369": {1},
+	"401": {1}, "403": {1}, "404": {1}, "405": {1}, "406": {1}, "441": {1, 2},
+	"442": {1}, "443": {1, 2}, "471": {1}, "473": {1}, "474": {1}, "475": {1},
+	"476": {1}, "477": {1}, "482": {1}, "671": {1},
+}
+
+// SplitNetworkName splits a name such as #chan/freenode into the name and its network.
+// The network is blank if the name doesn't have one.
+func SplitNetworkName(name string) (string, string) {
+	pos := strings.LastIndex(name, NetworkSeparator)
+	if pos < 1 {
+		return name, ""
+	}
+	return name[:pos], name[pos+1:]
+}
+
+// JoinNetworkName names a channel or nick along with the network it's on.
+func JoinNetworkName(name string, network string) string {
+	return name + NetworkSeparator + network
+}
+
+// Server returns the network the message being handled is for. Multi-network listeners name
+// a network in each message they send, others always talk to the network they logged in to.
+func (listener *Listener) Server() *ServerConnection {
+	if listener.MultiNetwork {
+		return listener.routedServer
+	}
+	return listener.ServerConnection
+}
+
+// Servers returns every network the listener sees, ordered by name.
+func (listener *Listener) Servers() []*ServerConnection {
+	servers := []*ServerConnection{}
+	if !listener.MultiNetwork {
+		if listener.ServerConnection != nil {
+			servers = append(servers, listener.ServerConnection)
+		}
+		return servers
+	}
+
+	for _, server := range listener.User.Networks {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
+// enableMultiNetwork moves the listener from the network it logged in to onto all of its user's networks
+func (listener *Listener) enableMultiNetwork() {
+	if listener.ServerConnection != nil {
+		listener.ServerConnection.RemoveListener(listener)
+	}
+
+	listener.MultiNetwork = true
+	for _, server := range listener.Servers() {
+		server.AddListener(listener)
+	}
+}
+
+// wantsMultiNetwork returns true if the listener should see all of its user's networks
+func (listener *Listener) wantsMultiNetwork() bool {
+	// BOUNCER clients manage networks themselves
+	if listener.User == nil || len(listener.User.Networks) == 0 || listener.IsCapEnabled("bouncer") {
+		return false
+	}
+	return listener.IsCapEnabled(MultiNetworkCap) || listener.ServerConnection == nil
+}
+
+// routeMessage strips the network names from the message's targets, returning the network
+// they name. Returns nil if the message doesn't name a network or names more than one.
+func (listener *Listener) routeMessage(msg *ircmsg.IrcMessage) *ServerConnection {
+	var server *ServerConnection
+
+	for _, idx := range multiNetworkTargets[strings.ToUpper(msg.Command)] {
+		if idx >= len(msg.Params) {
+			continue
+		}
+
+		targets := strings.Split(msg.Params[idx], ",")
+		for i, target := range targets {
+			name, networkName := SplitNetworkName(target)
+			network, exists := listener.User.Networks[networkName]
+			if networkName == "" || !exists {
+				continue
+			}
+			if server != nil && server != network {
+				return nil
+			}
+			server = network
+			targets[i] = name
+		}
+		msg.Params[idx] = strings.Join(targets, ",")
+	}
+
+	return server
+}
+
+// sendUnrouted deals with a message from a multi-network listener that doesn't name a network
+func (listener *Listener) sendUnrouted(msg *ircmsg.IrcMessage) {
+	// Being away is the same on every network
+	if strings.ToUpper(msg.Command) == "AWAY" {
+		line, _ := msg.Line()
+		for _, server := range listener.Servers() {
+			if server.Foo.Connected {
+				server.Foo.WriteLine("%s", line)
+			}
+		}
+		return
+	}
+
+	listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, "Could not tell which network "+msg.Command+" is for, name one as in #channel/network or nick/network")
+}
+
+// SendMultiNetworkConnect sends a connection init to a listener seeing all of its user's networks.
+func (listener *Listener) SendMultiNetworkConnect() {
+	listener.Send(nil, listener.Source, "001", listener.ClientNick, "- Welcome to GoshuBNC -")
+	listener.SendExtraISupports()
+	listener.Send(nil, listener.Source, "422", listener.ClientNick, "MOTD File is missing")
+	listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, "You are seeing all of your networks, channels and nicks are named as #channel/network and nick/network")
+}
+
+// ListenerName returns the name the listener knows a channel or nick on this network by.
+func (sc *ServerConnection) ListenerName(listener *Listener, name string) string {
+	if !listener.MultiNetwork || name == "" || name == "*" {
+		return name
+	}
+	if strings.EqualFold(name, sc.Foo.Nick) {
+		return listener.ClientNick
+	}
+	return JoinNetworkName(name, sc.Name)
+}
+
+// listenerPrefix returns the prefix of a message from this network as the listener knows it
+func (sc *ServerConnection) listenerPrefix(listener *Listener, prefix string) string {
+	// Servers are left as they are
+	if prefix == "" || !strings.Contains(prefix, "!") && strings.Contains(prefix, ".") {
+		return prefix
+	}
+
+	nick, _, _ := SplitMask(prefix)
+	return sc.ListenerName(listener, nick) + prefix[len(nick):]
+}
+
+// MessageForListener returns the message as the listener should see it, naming the network
+// of every channel and nick for multi-network listeners. Returns nil if the listener shouldn't
+// see the message at all.
+func (sc *ServerConnection) MessageForListener(listener *Listener, message *ircmsg.IrcMessage) *ircmsg.IrcMessage {
+	if !listener.MultiNetwork {
+		return message
+	}
+
+	// Each network's welcome isn't the client's, it has our own
+	if storedConnectLines[message.Command] {
+		return nil
+	}
+
+	params := make([]string, len(message.Params))
+	copy(params, message.Params)
+	rename := func(indexes ...int) {
+		for _, idx := range indexes {
+			if idx < len(params) {
+				params[idx] = sc.ListenerName(listener, params[idx])
+			}
+		}
+	}
+
+	switch message.Command {
+	case "NICK":
+		// The client keeps the one nick across every network
+		nick, _, _ := SplitMask(message.Prefix)
+		if strings.EqualFold(nick, sc.Foo.Nick) || len(params) > 0 && strings.EqualFold(params[0], sc.Foo.Nick) {
+			return nil
+		}
+		rename(0)
+	case "PRIVMSG", "NOTICE", "TAGMSG", "JOIN", "PART", "TOPIC", "MARKREAD":
+		rename(0)
+	case "KICK", "INVITE":
+		rename(0, 1)
+	case "MODE":
+		rename(0)
+		if len(params) > 2 {
+			renameModeParams(sc, listener, params[1], params[2:])
+		}
+	case "353":
+		rename(0, 2)
+		if len(params) > 3 {
+			names := strings.Split(params[3], " ")
+			for i, name := range names {
+				trimmed := strings.TrimLeft(name, "~&@%+")
+				if trimmed != "" {
+					names[i] = name[:len(name)-len(trimmed)] + sc.ListenerName(listener, trimmed)
+				}
+			}
+			params[3] = strings.Join(names, " ")
+		}
+	default:
+		if indexes, isNumeric := multiNetworkNumerics[message.Command]; isNumeric {
+			rename(0)
+			rename(indexes...)
+		} else if len(message.Command) == 3 {
+			rename(0)
+		}
+	}
+
+	rewritten := ircmsg.MakeMessage(&message.Tags, sc.listenerPrefix(listener, message.Prefix), message.Command, params...)
+	return &rewritten
+}
+
+// renameModeParams names the network of the nicks given to channel prefix modes such as +o
+func renameModeParams(sc *ServerConnection, listener *Listener, modes string, params []string) {
+	adding := true
+	idx := 0
+	for _, mode := range modes {
+		if idx >= len(params) {
+			return
+		}
+
+		switch {
+		case mode == '+' || mode == '-':
+			adding = mode == '+'
+		case strings.ContainsRune("qaohv", mode):
+			params[idx] = sc.ListenerName(listener, params[idx])
+			idx++
+		case strings.ContainsRune("beIk", mode) || adding && strings.ContainsRune("lfjL", mode):
+			idx++
+		}
+	}
+}
+
+// SendToListener sends a message from this network to the listener.
+func (sc *ServerConnection) SendToListener(listener *Listener, message *ircmsg.IrcMessage) {
+	message = sc.MessageForListener(listener, message)
+	if message != nil {
+		listener.SendMessage(message)
+	}
+}
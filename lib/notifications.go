@@ -0,0 +1,227 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// NotifyWebhook POSTs notifications to a URL
+	NotifyWebhook = "webhook"
+	// NotifyExec runs a local command for each notification
+	NotifyExec = "exec"
+
+	// DefaultNotifyRate is how many notifications a user gets per hour when they haven't chosen
+	DefaultNotifyRate = 30
+)
+
+var (
+	errUnknownNotifyKind = errors.New("Notification targets must be webhook or exec targets")
+	errNotifyExecOff     = errors.New("Running commands for notifications is disabled on this bouncer")
+	errInvalidQuietHours = errors.New("Quiet hours must be given as HH:MM-HH:MM")
+)
+
+// privateNetworks are the address ranges, along with loopback and link-local addresses, that
+// webhooks aren't posted to unless the bouncer's config allows them
+var privateNetworks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"}
+
+// NotificationsConfig holds the bouncer wide notification settings.
+type NotificationsConfig struct {
+	// AllowExec lets users run commands on the bouncer's host for their notifications
+	AllowExec bool `yaml:"allow-exec"`
+	// AllowPrivateWebhooks lets webhooks be posted to loopback, private and link-local addresses
+	AllowPrivateWebhooks bool `yaml:"allow-private-webhooks"`
+	// WebhookAllow lists the hosts, addresses and CIDRs webhooks can be posted to even though they're private
+	WebhookAllow []string `yaml:"webhook-allow"`
+}
+
+// WebhookAllowed returns true if webhooks can be posted to the given address of the given host.
+func (config *NotificationsConfig) WebhookAllowed(host string, ip net.IP) bool {
+	if config.AllowPrivateWebhooks || !isPrivateAddress(ip) {
+		return true
+	}
+
+	for _, allowed := range config.WebhookAllow {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+		if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+		if _, allowedNetwork, err := net.ParseCIDR(allowed); err == nil && allowedNetwork.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateAddress returns true if the given address is on the bouncer's host or its local networks
+func isPrivateAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, cidr := range privateNetworks {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifyTarget is somewhere a user's notifications are sent
+type NotifyTarget struct {
+	Kind string
+	// Target is the URL of a webhook or the command to run
+	Target string
+	// Template is an optional text/template used as the webhook body in place of the JSON payload
+	Template string
+}
+
+// NewNotifyTarget creates a notification target, making sure it's valid.
+func NewNotifyTarget(config *Config, kind string, target string, bodyTemplate string) (*NotifyTarget, error) {
+	notifyTarget := &NotifyTarget{
+		Kind:     strings.ToLower(kind),
+		Target:   target,
+		Template: bodyTemplate,
+	}
+
+	switch notifyTarget.Kind {
+	case NotifyWebhook:
+		webhookURL, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if webhookURL.Scheme != "http" && webhookURL.Scheme != "https" {
+			return nil, errors.New("Webhooks must be http or https URLs")
+		}
+	case NotifyExec:
+		if config == nil || !config.Bouncer.Notifications.AllowExec {
+			return nil, errNotifyExecOff
+		}
+		if strings.TrimSpace(target) == "" {
+			return nil, errors.New("No command was given")
+		}
+	default:
+		return nil, errUnknownNotifyKind
+	}
+
+	if bodyTemplate != "" {
+		_, err := template.New("notification").Parse(bodyTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return notifyTarget, nil
+}
+
+// String describes the target for the user
+func (target *NotifyTarget) String() string {
+	description := target.Kind + " " + target.Target
+	if target.Template != "" {
+		description += " with template " + target.Template
+	}
+	return description
+}
+
+// QuietHours is a time of day, such as 23:00-07:00, when notifications aren't sent
+type QuietHours struct {
+	// Start and End are minutes since midnight
+	Start int
+	End   int
+}
+
+// ParseQuietHours parses quiet hours given as HH:MM-HH:MM
+func ParseQuietHours(value string) (*QuietHours, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return nil, errInvalidQuietHours
+	}
+
+	minutes := make([]int, 2)
+	for i, part := range parts {
+		parsed, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, errInvalidQuietHours
+		}
+		minutes[i] = parsed.Hour()*60 + parsed.Minute()
+	}
+
+	return &QuietHours{
+		Start: minutes[0],
+		End:   minutes[1],
+	}, nil
+}
+
+// Contains returns true if the given time falls within the quiet hours
+func (quiet *QuietHours) Contains(ts time.Time) bool {
+	minute := ts.Hour()*60 + ts.Minute()
+	if quiet.Start <= quiet.End {
+		return minute >= quiet.Start && minute < quiet.End
+	}
+	// Quiet hours running over midnight
+	return minute >= quiet.Start || minute < quiet.End
+}
+
+func (quiet *QuietHours) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", quiet.Start/60, quiet.Start%60, quiet.End/60, quiet.End%60)
+}
+
+// NotifySettings are the user's notification settings
+type NotifySettings struct {
+	Targets []*NotifyTarget
+	// IdleAfter also sends notifications while clients are attached but the user hasn't
+	// said anything for this long, 0 only notifies while no clients are attached
+	IdleAfter time.Duration
+	// Rate is the most notifications sent per hour, 0 for the default
+	Rate  int
+	Quiet *QuietHours
+}
+
+// GetNotifySettings returns a copy of the user's notification settings.
+func (user *User) GetNotifySettings() NotifySettings {
+	user.notifyLock.Lock()
+	defer user.notifyLock.Unlock()
+
+	settings := user.Notify
+	settings.Targets = make([]*NotifyTarget, len(user.Notify.Targets))
+	copy(settings.Targets, user.Notify.Targets)
+	return settings
+}
+
+// UpdateNotifySettings changes the user's notification settings.
+func (user *User) UpdateNotifySettings(update func(settings *NotifySettings)) {
+	user.notifyLock.Lock()
+	defer user.notifyLock.Unlock()
+
+	update(&user.Notify)
+}
+
+// MarkActive records that the user has just done something on one of their clients.
+func (user *User) MarkActive() {
+	user.notifyLock.Lock()
+	defer user.notifyLock.Unlock()
+
+	user.lastActive = time.Now()
+}
+
+// ShouldNotify returns true if the user is away enough to be sent notifications.
+func (user *User) ShouldNotify() bool {
+	if !user.IsAttached() {
+		return true
+	}
+
+	user.notifyLock.Lock()
+	defer user.notifyLock.Unlock()
+
+	return user.Notify.IdleAfter > 0 && time.Since(user.lastActive) >= user.Notify.IdleAfter
+}
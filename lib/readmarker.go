@@ -0,0 +1,89 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+/**
+ * draft/read-marker
+ * Clients tell us how far they've read each buffer with MARKREAD. The marker is
+ * kept as the buffer's LastSeen and every other client of the user with the cap
+ * is told about it, so reading a buffer on one client marks it read on the rest.
+ */
+
+// ReadMarkerCap is the capability clients enable to receive read markers
+const ReadMarkerCap = "draft/read-marker"
+
+// ReadMarkerTimeFormat is how read marker times are sent
+const ReadMarkerTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// MarkRead moves the buffer's read marker forward. Returns false if the buffer
+// has already been read past the given time.
+func (buffer *ServerConnectionBuffer) MarkRead(read time.Time) bool {
+	read = read.UTC()
+	if !read.After(buffer.LastSeen) {
+		return false
+	}
+	buffer.LastSeen = read
+	return true
+}
+
+// readMarkerParam builds the timestamp param of a MARKREAD message
+func readMarkerParam(buffer *ServerConnectionBuffer) string {
+	if buffer == nil || buffer.LastSeen.IsZero() || buffer.LastSeen.Unix() <= 0 {
+		return "timestamp=*"
+	}
+	return "timestamp=" + buffer.LastSeen.UTC().Format(ReadMarkerTimeFormat)
+}
+
+// SendReadMarker tells the listener how far the given buffer has been read.
+func (sc *ServerConnection) SendReadMarker(listener *Listener, bufferName string) {
+	if !listener.IsCapEnabled(ReadMarkerCap) {
+		return
+	}
+	listener.Send(nil, listener.Manager.Source, "MARKREAD", sc.ListenerName(listener, bufferName), readMarkerParam(sc.Buffers.Get(bufferName)))
+}
+
+// SetReadMarker moves a buffer's read marker forward and tells every attached client about
+// it. Returns false if the buffer doesn't exist.
+func (sc *ServerConnection) SetReadMarker(bufferName string, read time.Time) bool {
+	buffer := sc.Buffers.Get(bufferName)
+	if buffer == nil {
+		return false
+	}
+
+	if buffer.MarkRead(read) {
+		err := sc.Save()
+		if err != nil {
+			// The marker still gets passed on, it's just lost if we restart
+			log.Println("Error saving the read marker of " + buffer.Name + ": " + err.Error())
+		}
+	}
+
+	sc.ListenersLock.Lock()
+	for _, listener := range sc.Listeners {
+		if listener.Registered {
+			sc.SendReadMarker(listener, buffer.Name)
+		}
+	}
+	sc.ListenersLock.Unlock()
+
+	return true
+}
+
+// parseReadMarker parses the timestamp param of a MARKREAD message
+func parseReadMarker(param string) (time.Time, bool) {
+	if !strings.HasPrefix(param, "timestamp=") {
+		return time.Time{}, false
+	}
+	read, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(param, "timestamp="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return read, true
+}
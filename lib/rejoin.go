@@ -0,0 +1,201 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+/**
+ * Channels we're kicked from can be rejoined automatically after a delay, trying
+ * a limited number of times if the server won't let us back in. Invites from an
+ * allowlist of nicks and accounts can be joined automatically too. Everything done
+ * is noted in the channel's log, so it can be seen even if nobody was attached.
+ */
+
+const (
+	// RejoinDefault uses the network's setting for rejoining the channel after a kick
+	RejoinDefault = ""
+	// RejoinOn always rejoins the channel after a kick
+	RejoinOn = "on"
+	// RejoinOff never rejoins the channel after a kick
+	RejoinOff = "off"
+
+	// DefaultRejoinDelay is how long we wait before rejoining a channel we were kicked from
+	DefaultRejoinDelay = 10 * time.Second
+	// DefaultRejoinTries is how many times we try to rejoin a channel we were kicked from
+	DefaultRejoinTries = 3
+
+	// InviteAccountPrefix marks invite allowlist entries that match accounts rather than nicks
+	InviteAccountPrefix = "account:"
+)
+
+// ShouldRejoin returns true if the given channel is rejoined after we're kicked from it.
+func (sc *ServerConnection) ShouldRejoin(buffer *ServerConnectionBuffer) bool {
+	switch buffer.Rejoin {
+	case RejoinOn:
+		return true
+	case RejoinOff:
+		return false
+	}
+	return sc.RejoinOnKick
+}
+
+// GetRejoinDelay returns how long we wait before rejoining a channel we were kicked from.
+func (sc *ServerConnection) GetRejoinDelay() time.Duration {
+	if sc.RejoinDelay > 0 {
+		return sc.RejoinDelay
+	}
+	return DefaultRejoinDelay
+}
+
+// GetRejoinTries returns how many times we try to rejoin a channel we were kicked from.
+func (sc *ServerConnection) GetRejoinTries() int {
+	if sc.RejoinTries > 0 {
+		return sc.RejoinTries
+	}
+	return DefaultRejoinTries
+}
+
+// InviteAllowed returns true if invites from the given nick or account are joined.
+func (sc *ServerConnection) InviteAllowed(nick string, account string) bool {
+	for _, entry := range sc.InviteAllow {
+		if strings.HasPrefix(entry, InviteAccountPrefix) {
+			if account != "" && strings.EqualFold(strings.TrimPrefix(entry, InviteAccountPrefix), account) {
+				return true
+			}
+		} else if strings.EqualFold(entry, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// NoteBuffer records something the bouncer did in a buffer's log.
+func (sc *ServerConnection) NoteBuffer(bufferName string, text string) {
+	sc.User.Manager.Bus.Dispatch(HookBufferNoteName, &HookBufferNote{
+		User:   sc.User,
+		Server: sc,
+		Buffer: bufferName,
+		Text:   text,
+	})
+}
+
+func (sc *ServerConnection) handleKick(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 || !strings.EqualFold(message.Params[1], sc.Foo.Nick) {
+		return
+	}
+
+	buffer := sc.Buffers.Get(message.Params[0])
+	if buffer == nil || !buffer.Channel || !sc.ShouldRejoin(buffer) {
+		return
+	}
+
+	sc.rejoinLock.Lock()
+	buffer.rejoinTries = 0
+	sc.rejoinLock.Unlock()
+
+	sc.scheduleRejoin(buffer)
+}
+
+// scheduleRejoin tries to rejoin a channel we were kicked from after the network's delay,
+// giving up once we've tried too many times
+func (sc *ServerConnection) scheduleRejoin(buffer *ServerConnectionBuffer) {
+	tries := sc.GetRejoinTries()
+
+	sc.rejoinLock.Lock()
+	try := buffer.rejoinTries + 1
+	if try > tries {
+		try = 0
+	}
+	buffer.rejoinTries = try
+	sc.rejoinLock.Unlock()
+
+	if try == 0 {
+		sc.NoteBuffer(buffer.Name, fmt.Sprintf("Gave up rejoining after %d tries", tries))
+		return
+	}
+
+	delay := sc.GetRejoinDelay()
+	sc.NoteBuffer(buffer.Name, fmt.Sprintf("Rejoining in %s (try %d of %d)", delay.String(), try, tries))
+
+	// The timer only uses what's copied here, everything else belongs to the connection's reader
+	name := buffer.Name
+	key := buffer.JoinKey()
+	time.AfterFunc(delay, func() {
+		if sc.rejoinPending(buffer) {
+			sc.Foo.JoinChannel(name, key)
+		}
+	})
+}
+
+// rejoinPending returns true if we're still trying to rejoin a channel
+func (sc *ServerConnection) rejoinPending(buffer *ServerConnectionBuffer) bool {
+	sc.rejoinLock.Lock()
+	defer sc.rejoinLock.Unlock()
+
+	return buffer.rejoinTries > 0
+}
+
+// StopRejoin stops trying to rejoin a channel, such as when a client parts it.
+func (sc *ServerConnection) StopRejoin(name string) {
+	buffer := sc.Buffers.Get(name)
+	if buffer == nil {
+		return
+	}
+
+	sc.rejoinLock.Lock()
+	buffer.rejoinTries = 0
+	sc.rejoinLock.Unlock()
+}
+
+// rejoinFailed tries again to rejoin a channel the server wouldn't let us back in to
+func (sc *ServerConnection) rejoinFailed(buffer *ServerConnectionBuffer) {
+	if sc.rejoinPending(buffer) {
+		sc.scheduleRejoin(buffer)
+	}
+}
+
+// rejoined notes that we made it back in to a channel we were kicked from
+func (sc *ServerConnection) rejoined(buffer *ServerConnectionBuffer) {
+	sc.rejoinLock.Lock()
+	wasRejoining := buffer.rejoinTries > 0
+	buffer.rejoinTries = 0
+	sc.rejoinLock.Unlock()
+
+	if wasRejoining {
+		sc.NoteBuffer(buffer.Name, "Rejoined")
+	}
+}
+
+func (sc *ServerConnection) handleInvite(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 || !strings.EqualFold(message.Params[0], sc.Foo.Nick) {
+		return
+	}
+	if sc.User.IsIgnored(sc, message) {
+		return
+	}
+
+	nick, _, _ := SplitMask(message.Prefix)
+	account := ""
+	if tag, exists := message.Tags["account"]; exists && tag.HasValue {
+		account = tag.Value
+	}
+	if !sc.InviteAllowed(nick, account) {
+		return
+	}
+
+	name := message.Params[1]
+	key := ""
+	if buffer := sc.Buffers.Get(name); buffer != nil {
+		key = buffer.JoinKey()
+	}
+
+	sc.NoteBuffer(name, "Joining on an invite from "+nick)
+	sc.Foo.JoinChannel(name, key)
+}
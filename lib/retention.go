@@ -0,0 +1,227 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// RetentionPolicy is a retention policy as written in the config file.
+// Anything left empty is inherited from the wider policy.
+type RetentionPolicy struct {
+	// Maximum age of stored messages, e.g. 12h or 90d
+	MaxAge string `yaml:"max-age"`
+	// Maximum number of messages stored per buffer
+	MaxMessages int `yaml:"max-messages"`
+	// Maximum size of the messages stored per buffer, e.g. 500k or 1g
+	MaxBytes string `yaml:"max-bytes"`
+}
+
+// UserRetentionConfig holds the retention policy of a user and their networks.
+type UserRetentionConfig struct {
+	RetentionPolicy `yaml:",inline"`
+	Networks        map[string]RetentionPolicy
+}
+
+// RetentionConfig holds the global, per-user and per-network retention policies.
+type RetentionConfig struct {
+	RetentionPolicy `yaml:",inline"`
+	// How often the pruner runs, e.g. 1h
+	Interval string
+	Users    map[string]UserRetentionConfig
+}
+
+// MessageRetention is a parsed retention policy. Zero values mean no limit.
+type MessageRetention struct {
+	MaxAge      time.Duration
+	MaxMessages int
+	MaxBytes    uint64
+}
+
+// IsEmpty returns true if this retention doesn't limit anything.
+func (retention MessageRetention) IsEmpty() bool {
+	return retention.MaxAge == 0 && retention.MaxMessages == 0 && retention.MaxBytes == 0
+}
+
+// String returns a readable description of this retention.
+func (retention MessageRetention) String() string {
+	limits := []string{}
+	if retention.MaxAge > 0 {
+		limits = append(limits, "max-age="+retention.MaxAge.String())
+	}
+	if retention.MaxMessages > 0 {
+		limits = append(limits, "max-messages="+strconv.Itoa(retention.MaxMessages))
+	}
+	if retention.MaxBytes > 0 {
+		limits = append(limits, "max-bytes="+bytefmt.ByteSize(retention.MaxBytes))
+	}
+
+	if len(limits) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(limits, " ")
+}
+
+// overlay returns this retention with any limits set in the given policy replacing our own.
+func (retention MessageRetention) overlay(policy RetentionPolicy) (MessageRetention, error) {
+	var err error
+
+	if policy.MaxAge != "" {
+		retention.MaxAge, err = ParseRetentionDuration(policy.MaxAge)
+		if err != nil {
+			return retention, err
+		}
+	}
+
+	if policy.MaxMessages > 0 {
+		retention.MaxMessages = policy.MaxMessages
+	}
+
+	if policy.MaxBytes != "" {
+		retention.MaxBytes, err = bytefmt.ToBytes(policy.MaxBytes)
+		if err != nil {
+			return retention, fmt.Errorf("Invalid max-bytes [%s]: %s", policy.MaxBytes, err.Error())
+		}
+	}
+
+	return retention, nil
+}
+
+// ParseRetentionDuration parses a duration, also accepting a number of days such as 30d.
+func ParseRetentionDuration(duration string) (time.Duration, error) {
+	if strings.HasSuffix(duration, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(duration, "d"))
+		if err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	parsed, err := time.ParseDuration(duration)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("Invalid duration [%s]", duration)
+	}
+
+	return parsed, nil
+}
+
+// RetentionFor returns the retention policy that applies to the given user's network.
+func (conf *RetentionConfig) RetentionFor(userID string, networkID string) (MessageRetention, error) {
+	retention, err := MessageRetention{}.overlay(conf.RetentionPolicy)
+	if err != nil {
+		return retention, err
+	}
+
+	userConf, exists := conf.Users[userID]
+	if !exists {
+		return retention, nil
+	}
+
+	retention, err = retention.overlay(userConf.RetentionPolicy)
+	if err != nil {
+		return retention, err
+	}
+
+	networkPolicy, exists := userConf.Networks[networkID]
+	if !exists {
+		return retention, nil
+	}
+
+	return retention.overlay(networkPolicy)
+}
+
+// PruneInterval returns how often the pruner should run, or 0 if it shouldn't run on a schedule.
+func (conf *RetentionConfig) PruneInterval() (time.Duration, error) {
+	if conf.Interval == "" {
+		return 0, nil
+	}
+	return ParseRetentionDuration(conf.Interval)
+}
+
+// validate makes sure every policy in the config can be parsed.
+func (conf *RetentionConfig) validate() error {
+	_, err := conf.PruneInterval()
+	if err != nil {
+		return err
+	}
+
+	_, err = conf.RetentionFor("", "")
+	if err != nil {
+		return err
+	}
+
+	for userID, userConf := range conf.Users {
+		_, err = conf.RetentionFor(userID, "")
+		if err != nil {
+			return err
+		}
+		for networkID := range userConf.Networks {
+			_, err = conf.RetentionFor(userID, networkID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PruneStats describes what was removed during a prune.
+type PruneStats struct {
+	Buffers  int
+	Messages int
+	Bytes    uint64
+}
+
+// Add adds the given stats onto these ones.
+func (stats *PruneStats) Add(other PruneStats) {
+	stats.Buffers += other.Buffers
+	stats.Messages += other.Messages
+	stats.Bytes += other.Bytes
+}
+
+// String returns a readable description of these stats.
+func (stats PruneStats) String() string {
+	return fmt.Sprintf("removed %d messages (%s) from %d buffers", stats.Messages, bytefmt.ByteSize(stats.Bytes), stats.Buffers)
+}
+
+// PruneMessages applies the configured retention policies to the stored messages of every user.
+func (m *Manager) PruneMessages() (PruneStats, error) {
+	stats := PruneStats{}
+
+	pruner, canPrune := m.Messages.(MessagePruner)
+	if !canPrune {
+		return stats, errMessagesCantPrune
+	}
+
+	// Users and networks can be added and removed while we prune, so we walk a snapshot of them
+	networks := make(map[string][]string)
+	m.UsersLock.RLock()
+	for _, user := range m.Users {
+		for name := range user.Networks {
+			networks[user.ID] = append(networks[user.ID], name)
+		}
+	}
+	m.UsersLock.RUnlock()
+
+	for userID, names := range networks {
+		for _, name := range names {
+			retention, err := m.Config.Bouncer.Retention.RetentionFor(userID, name)
+			if err != nil {
+				return stats, err
+			}
+			if retention.IsEmpty() {
+				continue
+			}
+
+			stats.Add(pruner.Prune(userID, name, retention))
+		}
+	}
+
+	return stats, nil
+}
@@ -6,6 +6,7 @@ package ircbnc
 import (
 	"crypto/tls"
 	"fmt"
+	"log"
 	"strings"
 	"sync"
 	"time"
@@ -38,6 +39,22 @@ type ServerConnection struct {
 	Password  string
 	Addresses []ServerConnectionAddress
 	Foo       *ircclient.Client
+
+	// RejoinOnKick rejoins channels we're kicked from, channels can override it
+	RejoinOnKick bool
+	RejoinDelay  time.Duration
+	RejoinTries  int
+	// InviteAllow lists the nicks, and accounts as account:<name>, whose invites are joined
+	InviteAllow []string
+
+	// requestedNick is the nick a client has asked to change to, until the server answers
+	requestedNick     string
+	requestedNickLock sync.Mutex
+	// joinKeys are the keys clients are joining channels with, until the joins succeed or fail
+	joinKeys     map[string]string
+	joinKeysLock sync.Mutex
+	// rejoinLock guards the rejoinTries of our buffers, which rejoin timers read
+	rejoinLock sync.Mutex
 }
 
 func NewServerConnection() *ServerConnection {
@@ -52,10 +69,23 @@ func NewServerConnection() *ServerConnection {
 	sc.Foo.HandleCommand(ircclient.RPL_WELCOME, sc.updateNickHandler)
 	sc.Foo.HandleCommand(ircclient.RPL_WELCOME, sc.joinSavedChannels)
 	sc.Foo.HandleCommand("NICK", sc.updateNickHandler)
+	sc.Foo.HandleCommand("NICK", sc.nickChangedHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_NONICKNAMEGIVEN, sc.nickRejectedHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_ERRONEUSNICKNAME, sc.nickRejectedHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_NICKNAMEINUSE, sc.nickRejectedHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_NICKCOLLISION, sc.nickRejectedHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_UNAVAILRESOURCE, sc.nickRejectedHandler)
 	sc.Foo.HandleCommand("ALL", sc.connectLinesHandler)
 	sc.Foo.HandleCommand("ALL", sc.rawToListeners)
 	sc.Foo.HandleCommand("CLOSED", sc.disconnectHandler)
 	sc.Foo.HandleCommand("JOIN", sc.handleJoin)
+	sc.Foo.HandleCommand("MODE", sc.handleModeKey)
+	sc.Foo.HandleCommand("KICK", sc.handleKick)
+	sc.Foo.HandleCommand("INVITE", sc.handleInvite)
+	sc.Foo.HandleCommand(ircclient.RPL_CHANNELMODEIS, sc.handleChannelModeIs)
+	for _, numeric := range joinErrors {
+		sc.Foo.HandleCommand(numeric, sc.handleJoinError)
+	}
 	sc.Foo.HandleCommand("PRIVMSG", sc.maybeCreateQueryBuffer)
 	sc.Foo.HandleCommand("NOTICE", sc.maybeCreateQueryBuffer)
 
@@ -72,11 +102,72 @@ type ServerConnectionAddress struct {
 type ServerConnectionAddresses []ServerConnectionAddress
 
 type ServerConnectionBuffer struct {
-	Channel  bool
-	Name     string
-	Key      string
-	UseKey   bool
+	Channel bool
+	Name    string
+	Key     string
+	UseKey  bool
+	// LastSeen is the read marker, how far the user has read the buffer on any client
 	LastSeen time.Time
+	// LogMode overrides the user's log mode for this buffer when set
+	LogMode string
+	// JoinError is why the channel last couldn't be joined, blank once it has been
+	JoinError string
+	// Detached channels stay joined and logged but aren't sent to clients
+	Detached bool
+	// Reattach is what reattaches the channel while it's detached, see the Reattach* constants
+	Reattach string
+	// Rejoin overrides whether the network rejoins this channel after a kick, see the Rejoin* constants
+	Rejoin string
+	// rejoinTries is how many times we've tried to rejoin since being kicked, guarded by the
+	// connection's rejoinLock
+	rejoinTries int
+
+	// clientsSeen is when each of the user's clients last saw this buffer, keyed by client ID.
+	// Every client's listener updates it, so it's only used through the methods below
+	clientsSeen     map[string]time.Time
+	clientsSeenLock sync.Mutex
+}
+
+// SeenBy returns when the given client last saw this buffer, or the zero time if it never has.
+func (buffer *ServerConnectionBuffer) SeenBy(clientID string) time.Time {
+	buffer.clientsSeenLock.Lock()
+	defer buffer.clientsSeenLock.Unlock()
+
+	return buffer.clientsSeen[clientID]
+}
+
+// MarkSeen records that the given client has seen this buffer up to the given time.
+func (buffer *ServerConnectionBuffer) MarkSeen(clientID string, seen time.Time) {
+	buffer.clientsSeenLock.Lock()
+	defer buffer.clientsSeenLock.Unlock()
+
+	seen = seen.UTC()
+	if buffer.clientsSeen == nil {
+		buffer.clientsSeen = make(map[string]time.Time)
+	}
+	if seen.After(buffer.clientsSeen[clientID]) {
+		buffer.clientsSeen[clientID] = seen
+	}
+}
+
+// ForgetSeen forgets when the given client last saw this buffer.
+func (buffer *ServerConnectionBuffer) ForgetSeen(clientID string) {
+	buffer.clientsSeenLock.Lock()
+	defer buffer.clientsSeenLock.Unlock()
+
+	delete(buffer.clientsSeen, clientID)
+}
+
+// ClientsSeen returns a copy of when each client last saw this buffer, keyed by client ID.
+func (buffer *ServerConnectionBuffer) ClientsSeen() map[string]time.Time {
+	buffer.clientsSeenLock.Lock()
+	defer buffer.clientsSeenLock.Unlock()
+
+	clientsSeen := make(map[string]time.Time, len(buffer.clientsSeen))
+	for clientID, seen := range buffer.clientsSeen {
+		clientsSeen[clientID] = seen
+	}
+	return clientsSeen
 }
 
 type ServerConnectionBuffers map[string]*ServerConnectionBuffer
@@ -137,6 +228,18 @@ func (sc *ServerConnection) Save() error {
 	return BNC.Ds.SaveConnection(sc)
 }
 
+// LogMode returns how messages in the given buffer are logged.
+func (sc *ServerConnection) LogMode(bufferName string) string {
+	buffer := sc.Buffers.Get(bufferName)
+	if buffer != nil && buffer.LogMode != LogModeDefault {
+		return buffer.LogMode
+	}
+	if sc.User != nil && sc.User.LogMode != LogModeDefault {
+		return sc.User.LogMode
+	}
+	return LogModeAll
+}
+
 // disconnectHandler extracts and stores .
 func (sc *ServerConnection) disconnectHandler(message *ircmsg.IrcMessage) {
 	for _, listener := range sc.Listeners {
@@ -148,22 +251,68 @@ func (sc *ServerConnection) updateNickHandler(message *ircmsg.IrcMessage) {
 	// Update the nick we have for the client before the message gets piped down
 	// to the client
 	for _, listener := range sc.Listeners {
-		if listener.Registered && sc.Foo.Nick != listener.ClientNick {
+		if listener.Registered && !listener.MultiNetwork && sc.Foo.Nick != listener.ClientNick {
 			listener.ClientNick = sc.Foo.Nick
 		}
 	}
 }
 
+// RequestNick remembers that a client asked to change nick, so that the change can be kept
+// once the server confirms it.
+func (sc *ServerConnection) RequestNick(nick string) {
+	sc.requestedNickLock.Lock()
+	sc.requestedNick = nick
+	sc.requestedNickLock.Unlock()
+}
+
+func (sc *ServerConnection) nickChangedHandler(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 1 {
+		return
+	}
+
+	// Only our own nick change answers the request, the client already has its NICK
+	sc.requestedNickLock.Lock()
+	isRequested := sc.requestedNick != "" && strings.EqualFold(message.Params[0], sc.Foo.Nick) && strings.EqualFold(message.Params[0], sc.requestedNick)
+	if isRequested {
+		sc.requestedNick = ""
+	}
+	sc.requestedNickLock.Unlock()
+
+	if !isRequested {
+		return
+	}
+
+	if sc.User.SaveNick && sc.Nickname != sc.Foo.Nick {
+		sc.Nickname = sc.Foo.Nick
+		err := sc.Save()
+		if err != nil {
+			log.Println("Error saving the nick of " + sc.Name + ": " + err.Error())
+		}
+	}
+}
+
+// nickRejectedHandler forgets a requested nick the server refused, the client sees the numeric
+func (sc *ServerConnection) nickRejectedHandler(message *ircmsg.IrcMessage) {
+	sc.requestedNickLock.Lock()
+	sc.requestedNick = ""
+	sc.requestedNickLock.Unlock()
+}
+
 func (sc *ServerConnection) joinSavedChannels(message *ircmsg.IrcMessage) {
 	// Join our channels
 	for _, channel := range sc.Buffers {
 		if channel.Channel {
-			sc.Foo.JoinChannel(channel.Name, channel.Key)
+			sc.Foo.JoinChannel(channel.Name, channel.JoinKey())
 		}
 	}
 }
 
 func (sc *ServerConnection) rawToListeners(message *ircmsg.IrcMessage) {
+	// Ignored messages go nowhere, not even to the logs
+	if sc.User.IsIgnored(sc, message) {
+		return
+	}
+
 	hook := &HookIrcRaw{
 		FromServer: true,
 		User:       sc.User,
@@ -176,10 +325,18 @@ func (sc *ServerConnection) rawToListeners(message *ircmsg.IrcMessage) {
 		return
 	}
 
+	// Detached channels are kept from clients unless something reattaches them
+	if buffer := sc.detachedBuffer(message); buffer != nil {
+		if !sc.shouldReattach(buffer, message) {
+			return
+		}
+		sc.AttachBuffer(buffer.Name)
+	}
+
 	sc.ListenersLock.Lock()
 	for _, listener := range sc.Listeners {
 		if listener.Registered {
-			listener.SendMessage(message)
+			sc.SendToListener(listener, message)
 		}
 	}
 	sc.ListenersLock.Unlock()
@@ -254,10 +411,15 @@ func (sc *ServerConnection) DumpRegistration(listener *Listener) {
 
 func (sc *ServerConnection) DumpChannels(listener *Listener) {
 	for _, buffer := range sc.Buffers {
+		if buffer.Detached {
+			continue
+		}
 		if buffer.Channel {
-			listener.Send(nil, sc.CurrentMask, "JOIN", buffer.Name)
+			join := ircmsg.MakeMessage(nil, sc.CurrentMask, "JOIN", buffer.Name)
+			sc.SendToListener(listener, &join)
 			sc.Foo.WriteLine("NAMES %s", buffer.Name)
 		}
+		sc.SendReadMarker(listener, buffer.Name)
 	}
 }
 
@@ -267,7 +429,9 @@ func (sc *ServerConnection) AddListener(listener *Listener) {
 	sc.Listeners = append(sc.Listeners, listener)
 	sc.ListenersLock.Unlock()
 
-	listener.ServerConnection = sc
+	if !listener.MultiNetwork {
+		listener.ServerConnection = sc
+	}
 }
 
 func (sc *ServerConnection) RemoveListener(listener *Listener) {
@@ -281,7 +445,9 @@ func (sc *ServerConnection) RemoveListener(listener *Listener) {
 	sc.Listeners = newSlice
 	sc.ListenersLock.Unlock()
 
-	listener.ServerConnection = nil
+	if listener.ServerConnection == sc {
+		listener.ServerConnection = nil
+	}
 }
 
 func (sc *ServerConnection) ReadyToConnect() bool {
@@ -367,14 +533,30 @@ func (sc *ServerConnection) handleJoin(message *ircmsg.IrcMessage) {
 
 	name := params[0]
 	buffer := sc.Buffers.Get(name)
+	key, hasKey := sc.takeJoinKey(name)
 
 	if buffer == nil {
 		sc.Buffers.Add(&ServerConnectionBuffer{
 			Channel: true,
 			Name:    name,
+			Key:     key,
+			UseKey:  hasKey,
 		})
 
 		sc.Save()
+		return
+	}
+
+	sc.rejoined(buffer)
+
+	// The key a client joined with worked, and whatever stopped us joining before is gone
+	changed := hasKey && buffer.SetKey(key)
+	if buffer.JoinError != "" {
+		buffer.JoinError = ""
+		changed = true
+	}
+	if changed {
+		sc.Save()
 	}
 }
 
@@ -386,6 +568,11 @@ func (sc *ServerConnection) maybeCreateQueryBuffer(message *ircmsg.IrcMessage) {
 		return
 	}
 
+	// Ignored senders don't get a query opened for them
+	if sc.User.IsIgnored(sc, message) {
+		return
+	}
+
 	prefixNick, _, _ := SplitMask(message.Prefix)
 	isPm := strings.ToLower(params[0]) == sc.Foo.Nick
 
@@ -64,6 +64,11 @@ func (socket *Socket) Close() {
 	go socket.timedFillLineToSendExists(200 * time.Millisecond)
 }
 
+// RemoteAddr returns the address of our peer.
+func (socket *Socket) RemoteAddr() string {
+	return socket.conn.RemoteAddr().String()
+}
+
 // CertFP returns the fingerprint of the certificate provided by our peer.
 func (socket *Socket) CertFP() (string, error) {
 	var tlsConn, isTLS = socket.conn.(*tls.Conn)
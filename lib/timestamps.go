@@ -0,0 +1,79 @@
+// Copyright (c) 2017 Darren Whitlen <darren@kiwiirc.com>
+// released under the MIT license
+
+package ircbnc
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultPlaybackTimestamp is how played back messages are timestamped for clients without server-time
+	DefaultPlaybackTimestamp = "[%H:%M]"
+	// PlaybackTimestampOff stops played back messages from being timestamped
+	PlaybackTimestampOff = "off"
+)
+
+// FormatTimestamp formats a time using strftime style directives: %Y %y %m %d %H %M %S %Z and %%.
+func FormatTimestamp(format string, ts time.Time) string {
+	var formatted bytes.Buffer
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			formatted.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		switch format[i] {
+		case 'Y':
+			formatted.WriteString(strconv.Itoa(ts.Year()))
+		case 'y':
+			formatted.WriteString(ts.Format("06"))
+		case 'm':
+			formatted.WriteString(ts.Format("01"))
+		case 'd':
+			formatted.WriteString(ts.Format("02"))
+		case 'H':
+			formatted.WriteString(ts.Format("15"))
+		case 'M':
+			formatted.WriteString(ts.Format("04"))
+		case 'S':
+			formatted.WriteString(ts.Format("05"))
+		case 'Z':
+			formatted.WriteString(ts.Format("MST"))
+		case '%':
+			formatted.WriteByte('%')
+		default:
+			formatted.WriteByte('%')
+			formatted.WriteByte(format[i])
+		}
+	}
+
+	return formatted.String()
+}
+
+// GetPlaybackTimestamp returns the timestamp this user's played back messages are prefixed
+// with for clients without server-time, or a blank string if they've turned it off.
+func (user *User) GetPlaybackTimestamp(ts time.Time) string {
+	return user.FormatPlaybackTimestamp(user.PlaybackTimestamp, ts)
+}
+
+// FormatPlaybackTimestamp formats a playback timestamp in the user's timezone, where a
+// blank format is the default and PlaybackTimestampOff returns a blank string.
+func (user *User) FormatPlaybackTimestamp(format string, ts time.Time) string {
+	if format == PlaybackTimestampOff {
+		return ""
+	}
+	if format == "" {
+		format = DefaultPlaybackTimestamp
+	}
+
+	location := user.Location()
+	if location == nil {
+		location = time.Local
+	}
+	return FormatTimestamp(format, ts.In(location))
+}
@@ -3,6 +3,41 @@
 
 package ircbnc
 
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// MessageStoreDefault stores the user's messages in the configured message datastore
+	MessageStoreDefault = ""
+	// MessageStoreMemory only keeps the user's latest messages in memory
+	MessageStoreMemory = "memory"
+)
+
+const (
+	// LogModeDefault inherits the log mode from the user, or logs everything if it's the user's mode
+	LogModeDefault = ""
+	// LogModeAll stores messages in the user's message store
+	LogModeAll = "all"
+	// LogModePlayback only keeps messages in memory for playback, nothing is written to disk
+	LogModePlayback = "playback"
+	// LogModeNone doesn't store messages at all
+	LogModeNone = "none"
+)
+
+// DefaultPlaybackLimit is the most messages per buffer played back on attach when the user hasn't chosen a limit
+const DefaultPlaybackLimit = 50
+
+// IsValidLogMode returns true if the given log mode is one we know about.
+func IsValidLogMode(mode string) bool {
+	switch mode {
+	case LogModeDefault, LogModeAll, LogModePlayback, LogModeNone:
+		return true
+	}
+	return false
+}
+
 // User represents an ircbnc user.
 type User struct {
 	Manager *Manager
@@ -21,6 +56,56 @@ type User struct {
 	DefaultUser   string
 	DefaultReal   string
 
+	Timezone string
+	// MessageStore is where this user's messages are stored, see the MessageStore* constants
+	MessageStore string
+	// MemoryBufferSize is how many messages per buffer are kept in memory, 0 for the default
+	MemoryBufferSize int
+	// LogMode is how this user's messages are logged, buffers can override it
+	LogMode string
+	// PlaybackLimit is the most messages per buffer played back on attach, 0 for the default
+	PlaybackLimit int
+	// PlaybackTimestamp is the strftime style format played back messages are prefixed with
+	// for clients without server-time, blank for the default or PlaybackTimestampOff
+	PlaybackTimestamp string
+	// SaveNick keeps the nicks the user changes to on a network as that network's nick
+	SaveNick bool
+
+	// Clients are the user's named clients, keyed by client ID
+	Clients     map[string]*UserClient
+	clientsLock sync.Mutex
+
+	// HighlightNickOff stops the user's nick from highlighting them, leaving only their rules
+	HighlightNickOff bool
+	HighlightRules   []*HighlightRule
+	highlightLock    sync.Mutex
+	mentionsLock     sync.Mutex
+
+	// location caches the loaded Timezone, locationName is the timezone it was loaded from
+	location     *time.Location
+	locationName string
+	locationLock sync.Mutex
+
+	// IgnoreRules drop messages from the networks before clients or logs see them
+	IgnoreRules []*IgnoreRule
+	ignoreLock  sync.Mutex
+
+	// Notify is where and when the user is notified of highlights and private messages
+	Notify     NotifySettings
+	notifyLock sync.Mutex
+	lastActive time.Time
+
+	// LogPublicKey is used to encrypt stored messages when set
+	LogPublicKey []byte
+	// LogPrivateKey is the private key for the log keypair, wrapped with a key derived from the password
+	LogPrivateKey []byte
+	LogKeySalt    []byte
+
+	// logPrivateKey is only set while the user has authenticated sessions
+	logPrivateKey *[32]byte
+	logSessions   int
+	logKeyLock    sync.Mutex
+
 	Networks map[string]*ServerConnection
 }
 
@@ -28,6 +113,7 @@ func NewUser(manager *Manager) *User {
 	return &User{
 		Manager:  manager,
 		Networks: make(map[string]*ServerConnection),
+		Clients:  make(map[string]*UserClient),
 	}
 }
 
@@ -39,3 +125,32 @@ func (user *User) StartServerConnections() {
 		}
 	}
 }
+
+// GetPlaybackLimit returns the most messages per buffer that are played back to this user's clients.
+func (user *User) GetPlaybackLimit() int {
+	if user.PlaybackLimit > 0 {
+		return user.PlaybackLimit
+	}
+	return DefaultPlaybackLimit
+}
+
+// Location returns the timezone the user has chosen, or nil if they haven't set a valid one.
+func (user *User) Location() *time.Location {
+	user.locationLock.Lock()
+	defer user.locationLock.Unlock()
+
+	// Loading a timezone reads the tz database, so it's only done when the timezone changes
+	if user.locationName == user.Timezone {
+		return user.location
+	}
+
+	user.locationName = user.Timezone
+	user.location = nil
+	if user.Timezone != "" {
+		location, err := time.LoadLocation(user.Timezone)
+		if err == nil {
+			user.location = location
+		}
+	}
+	return user.location
+}